@@ -1,70 +1,80 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"encoding/xml"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/LeeZeitz/DayTradingSystem/shared/health"
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/metrics"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/LeeZeitz/DayTradingSystem/shared/shutdown"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
 	_ "github.com/herenow/go-crate"
 )
 
-var (
-	auditstring = func() string {
-		if runningInDocker() {
-			return "http://audit-db:4200"
-		}
-		return "http://localhost:4201"
-	}()
+var db = loadDb(cfg.DatabaseURL)
 
-	db = loadDb(auditstring)
-)
+// Dumps that are being written
+var dumps sync.WaitGroup
 
-func runningInDocker() bool {
-	if _, err := os.Stat("/.dockerenv"); !os.IsNotExist(err) {
-		return true
+func failOnError(err error, msg string) {
+	if err != nil {
+		slog.Error(msg, "error", err)
+		panic(err)
 	}
-	return false
 }
 
-func failOnError(err error, msg string) {
+// Logs the error with the user, transaction and command of the event being recorded, then panics
+func failEventOnError(event *slog.Logger, err error, msg string) {
 	if err != nil {
-		fmt.Printf("%s: %s", msg, err)
+		event.Error(msg, "error", err)
 		panic(err)
 	}
 }
 
 func loadDb(dbstring string) *sql.DB {
-	db, err := sql.Open("crate", auditstring)
+	db, err := sql.Open("crate", dbstring)
 
 	// If can't connect to DB
 	failOnError(err, "Couldn't connect to CrateDB")
 	err = db.Ping()
 	failOnError(err, "Couldn't ping CrateDB")
-	println("connected to db")
+	slog.Info("Connected to CrateDB")
 	return db
 }
 
+// Runs a query, since opening a connection to CrateDB doesn't reach the server
+func pingDb(ctx context.Context) error {
+	var one int
+	return db.QueryRowContext(ctx, "SELECT 1;").Scan(&one)
+}
+
 func createTimestamp() int64 {
 	return time.Now().UTC().UnixNano() / int64(time.Millisecond)
 }
 
 // UserCommand data type
 type UserCommand struct {
-	XMLName        xml.Name `xml:"userCommand"`
-	Timestamp      int      `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int      `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username,omitempty"`
-	StockSymbol    string   `xml:"stockSymbol,omitempty"`
-	Filename       string   `xml:"filename,omitempty"`
-	Funds          float64  `xml:"funds,omitempty"`
+	XMLName        xml.Name    `xml:"userCommand"`
+	Timestamp      int         `xml:"timestamp"`
+	Server         string      `xml:"server"`
+	TransactionNum int         `xml:"transactionNum"`
+	Command        string      `xml:"command"`
+	Username       string      `xml:"username,omitempty"`
+	StockSymbol    string      `xml:"stockSymbol,omitempty"`
+	Filename       string      `xml:"filename,omitempty"`
+	Funds          money.Money `xml:"funds,omitempty"`
 }
 
 func (uc UserCommand) GetTimestamp() int {
@@ -77,15 +87,15 @@ func (uc UserCommand) GetTransactionNum() int {
 
 // SystemEvent data type
 type SystemEvent struct {
-	XMLName        xml.Name `xml:"systemEvent"`
-	Timestamp      int      `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int      `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username,omitempty"`
-	StockSymbol    string   `xml:"stockSymbol,omitempty"`
-	Filename       string   `xml:"filename,omitempty"`
-	Funds          float64  `xml:"funds,omitempty"`
+	XMLName        xml.Name    `xml:"systemEvent"`
+	Timestamp      int         `xml:"timestamp"`
+	Server         string      `xml:"server"`
+	TransactionNum int         `xml:"transactionNum"`
+	Command        string      `xml:"command"`
+	Username       string      `xml:"username,omitempty"`
+	StockSymbol    string      `xml:"stockSymbol,omitempty"`
+	Filename       string      `xml:"filename,omitempty"`
+	Funds          money.Money `xml:"funds,omitempty"`
 }
 
 func (se SystemEvent) GetTimestamp() int {
@@ -98,15 +108,15 @@ func (se SystemEvent) GetTransactionNum() int {
 
 // QuoteServer data type
 type QuoteServer struct {
-	XMLName         xml.Name `xml:"quoteServer"`
-	Timestamp       int      `xml:"timestamp"`
-	Server          string   `xml:"server"`
-	TransactionNum  int      `xml:"transactionNum"`
-	Price           float64  `xml:"price"`
-	StockSymbol     string   `xml:"stockSymbol"`
-	Username        string   `xml:"username"`
-	QuoteServerTime int      `xml:"quoteServerTime"`
-	CryptoKey       string   `xml:"cryptokey"`
+	XMLName         xml.Name    `xml:"quoteServer"`
+	Timestamp       int         `xml:"timestamp"`
+	Server          string      `xml:"server"`
+	TransactionNum  int         `xml:"transactionNum"`
+	Price           money.Money `xml:"price"`
+	StockSymbol     string      `xml:"stockSymbol"`
+	Username        string      `xml:"username"`
+	QuoteServerTime int         `xml:"quoteServerTime"`
+	CryptoKey       string      `xml:"cryptokey"`
 }
 
 func (qs QuoteServer) GetTimestamp() int {
@@ -119,13 +129,13 @@ func (qs QuoteServer) GetTransactionNum() int {
 
 // AccountTransaction data type
 type AccountTransaction struct {
-	XMLName        xml.Name `xml:"accountTransaction"`
-	Timestamp      int      `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int      `xml:"transactionNum"`
-	Action         string   `xml:"action"`
-	Username       string   `xml:"username"`
-	Funds          float64  `xml:"funds"`
+	XMLName        xml.Name    `xml:"accountTransaction" json:"-"`
+	Timestamp      int         `xml:"timestamp"`
+	Server         string      `xml:"server"`
+	TransactionNum int         `xml:"transactionNum"`
+	Action         string      `xml:"action"`
+	Username       string      `xml:"username"`
+	Funds          money.Money `xml:"funds"`
 }
 
 func (at AccountTransaction) GetTimestamp() int {
@@ -138,16 +148,16 @@ func (at AccountTransaction) GetTransactionNum() int {
 
 // ErrorEvent data type
 type ErrorEvent struct {
-	XMLName        xml.Name `xml:"errorEvent"`
-	Timestamp      int      `xml:"timestamp"`
-	Server         string   `xml:"server"`
-	TransactionNum int      `xml:"transactionNum"`
-	Command        string   `xml:"command"`
-	Username       string   `xml:"username,omitempty"`
-	StockSymbol    string   `xml:"stockSymbol,omitempty"`
-	Filename       string   `xml:"filename,omitempty"`
-	Funds          float64  `xml:"funds,omitempty"`
-	ErrorMessage   string   `xml:"errorMessage,omitempty"`
+	XMLName        xml.Name    `xml:"errorEvent"`
+	Timestamp      int         `xml:"timestamp"`
+	Server         string      `xml:"server"`
+	TransactionNum int         `xml:"transactionNum"`
+	Command        string      `xml:"command"`
+	Username       string      `xml:"username,omitempty"`
+	StockSymbol    string      `xml:"stockSymbol,omitempty"`
+	Filename       string      `xml:"filename,omitempty"`
+	Funds          money.Money `xml:"funds,omitempty"`
+	ErrorMessage   string      `xml:"errorMessage,omitempty"`
 }
 
 func (ee ErrorEvent) GetTimestamp() int {
@@ -163,197 +173,274 @@ type LogType interface {
 	GetTransactionNum() int
 }
 
-func logUserCommandHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-
-	req := struct {
-		TransactionNum int
-		Server         string
-		Command        string
-		Username       string
-		Stock          string
-		Filename       string
-		Funds          float64
-	}{0, "", "", "", "", "", 0.0}
-
-	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	queryString := "INSERT INTO user_commands (command, filename, funds, server, stock, timestamp, transaction_num, user_id)" +
-		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
-
-	timestamp := createTimestamp()
-
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare user command log query")
+// Returns the time an event happened: when the transaction server logged it if it says, otherwise now
+func eventTimestamp(timestamp int64) int64 {
+	if timestamp == 0 {
+		return createTimestamp()
+	}
+	return timestamp
+}
 
-	res, err := stmt.Exec(req.Command, req.Filename, req.Funds, req.Server, req.Stock, timestamp, req.TransactionNum, req.Username)
-	failOnError(err, "Failed to add user command log")
+// Runs an insert that has to add exactly one row
+func insertEvent(query string, args ...interface{}) error {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return err
+	}
 	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failOnError(err, "Failed to add user command log")
+	if err == nil && numrows < 1 {
+		err = errors.New("no rows inserted")
 	}
+	return err
+}
 
+// An event sent to /logUserCommand
+type userCommandRequest struct {
+	TransactionNum int
+	Server         string
+	Command        string
+	Username       string
+	Stock          string
+	Filename       string
+	Funds          money.Money
+	Timestamp      int64 // when the event happened, in unix ms. Zero means now
 }
 
-func logSystemEventHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+func (req *userCommandRequest) logger(ctx context.Context) *slog.Logger {
+	return logging.ForCommand(ctx, req.Username, req.TransactionNum, req.Command)
+}
 
-	req := struct {
-		TransactionNum int
-		Server         string
-		Command        string
-		Username       string
-		Stock          string
-		Filename       string
-		Funds          float64
-	}{0, "", "", "", "", "", 0.0}
+func (req *userCommandRequest) insert() error {
+	defer metrics.TimeQuery("user_commands.insert")()
+	queryString := "INSERT INTO user_commands (command, filename, funds, server, stock, timestamp, transaction_num, user_id)" +
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	return insertEvent(queryString, req.Command, req.Filename, req.Funds, req.Server, req.Stock,
+		eventTimestamp(req.Timestamp), req.TransactionNum, req.Username)
+}
 
-	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
+// An event sent to /logSystemEvent
+type systemEventRequest struct {
+	TransactionNum int
+	Server         string
+	Command        string
+	Username       string
+	Stock          string
+	Filename       string
+	Funds          money.Money
+	Timestamp      int64
+}
+
+func (req *systemEventRequest) logger(ctx context.Context) *slog.Logger {
+	return logging.ForCommand(ctx, req.Username, req.TransactionNum, req.Command)
+}
 
+func (req *systemEventRequest) insert() error {
+	defer metrics.TimeQuery("system_events.insert")()
 	queryString := "INSERT INTO system_events (command, filename, funds, server, stock, timestamp, transaction_num, user_id)" +
 		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	return insertEvent(queryString, req.Command, req.Filename, req.Funds, req.Server, req.Stock,
+		eventTimestamp(req.Timestamp), req.TransactionNum, req.Username)
+}
 
-	timestamp := createTimestamp()
+// An event sent to /logQuoteServer
+type quoteServerRequest struct {
+	TransactionNum  int
+	Server          string
+	Username        string
+	Stock           string
+	CryptoKey       string
+	QuoteServerTime int
+	Price           money.Money
+	Timestamp       int64
+}
 
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare system event log query")
+func (req *quoteServerRequest) logger(ctx context.Context) *slog.Logger {
+	return logging.ForCommand(ctx, req.Username, req.TransactionNum, "")
+}
 
-	res, err := stmt.Exec(req.Command, req.Filename, req.Funds, req.Server, req.Stock, timestamp, req.TransactionNum, req.Username)
-	failOnError(err, "Failed to add system event log")
+func (req *quoteServerRequest) insert() error {
+	defer metrics.TimeQuery("quote_server_events.insert")()
+	queryString := "INSERT INTO quote_server_events (crypto_key, price, quote_server_time, server, stock, timestamp, transaction_num, user_id)" +
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+	return insertEvent(queryString, req.CryptoKey, req.Price, req.QuoteServerTime, req.Server, req.Stock,
+		eventTimestamp(req.Timestamp), req.TransactionNum, req.Username)
+}
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failOnError(err, "Failed to add system event log")
-	}
+// An event sent to /logAccountTransaction
+type accountTransactionRequest struct {
+	TransactionNum int
+	Server         string
+	Action         string
+	Username       string
+	Funds          money.Money
+	Timestamp      int64
 }
 
-func logQuoteServerHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+func (req *accountTransactionRequest) logger(ctx context.Context) *slog.Logger {
+	return logging.ForCommand(ctx, req.Username, req.TransactionNum, "")
+}
 
-	req := struct {
-		TransactionNum  int
-		Server          string
-		Username        string
-		Stock           string
-		CryptoKey       string
-		QuoteServerTime int
-		Price           float64
-	}{0, "", "", "", "", 0, 0.0}
+func (req *accountTransactionRequest) insert() error {
+	defer metrics.TimeQuery("account_transactions.insert")()
+	queryString := "INSERT INTO account_transactions (action, funds, server, timestamp, transaction_num, user_id)" +
+		" VALUES ($1, $2, $3, $4, $5, $6)"
+	return insertEvent(queryString, req.Action, req.Funds, req.Server, eventTimestamp(req.Timestamp),
+		req.TransactionNum, req.Username)
+}
 
-	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
+// An event sent to /logErrorEvent
+type errorEventRequest struct {
+	TransactionNum int
+	Server         string
+	Command        string
+	Username       string
+	Stock          string
+	Filename       string
+	ErrorMessage   string
+	Funds          money.Money
+	Timestamp      int64
+}
 
-	queryString := "INSERT INTO quote_server_events (crypto_key, price, quote_server_time, server, stock, timestamp, transaction_num, user_id)" +
-		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+func (req *errorEventRequest) logger(ctx context.Context) *slog.Logger {
+	return logging.ForCommand(ctx, req.Username, req.TransactionNum, req.Command)
+}
 
-	timestamp := createTimestamp()
+func (req *errorEventRequest) insert() error {
+	defer metrics.TimeQuery("error_events.insert")()
+	queryString := "INSERT INTO error_events (command, error_message, filename, funds, server, stock, timestamp, transaction_num, user_id)" +
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	return insertEvent(queryString, req.Command, req.ErrorMessage, req.Filename, req.Funds, req.Server, req.Stock,
+		eventTimestamp(req.Timestamp), req.TransactionNum, req.Username)
+}
 
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare quote server event log query")
+func logUserCommandHandler(w http.ResponseWriter, r *http.Request) {
+	req := &userCommandRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	failOnError(err, "Failed to parse the request")
+	failEventOnError(req.logger(r.Context()), req.insert(), "Failed to add user command log")
+}
 
-	res, err := stmt.Exec(req.CryptoKey, req.Price, req.QuoteServerTime, req.Server, req.Stock, timestamp, req.TransactionNum, req.Username)
-	failOnError(err, "Failed to add quote server event log")
+func logSystemEventHandler(w http.ResponseWriter, r *http.Request) {
+	req := &systemEventRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	failOnError(err, "Failed to parse the request")
+	failEventOnError(req.logger(r.Context()), req.insert(), "Failed to add system event log")
+}
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failOnError(err, "Failed to add quote server event log")
-	}
+func logQuoteServerHandler(w http.ResponseWriter, r *http.Request) {
+	req := &quoteServerRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	failOnError(err, "Failed to parse the request")
+	failEventOnError(req.logger(r.Context()), req.insert(), "Failed to add quote server event log")
 }
 
 func logAccountTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	req := &accountTransactionRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	failOnError(err, "Failed to parse the request")
+	failEventOnError(req.logger(r.Context()), req.insert(), "Failed to add account transaction log")
+}
+
+func logErrorEventHandler(w http.ResponseWriter, r *http.Request) {
+	req := &errorEventRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	failOnError(err, "Failed to parse the request")
+	failEventOnError(req.logger(r.Context()), req.insert(), "Failed to add error events log")
+}
+
+func dumpLogHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	req := struct {
 		TransactionNum int
-		Server         string
-		Action         string
-		Username       string
-		Funds          float64
-	}{0, "", "", "", 0.0}
-
+		Filename       string
+	}{0, ""}
 	err := decoder.Decode(&req)
 	failOnError(err, "Failed to parse the request")
 
-	queryString := "INSERT INTO account_transactions (action, funds, server, timestamp, transaction_num, user_id)" +
-		" VALUES ($1, $2, $3, $4, $5, $6)"
-
-	timestamp := createTimestamp()
-
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare account transaction log query")
-
-	res, err := stmt.Exec(req.Action, req.Funds, req.Server, timestamp, req.TransactionNum, req.Username)
-	failOnError(err, "Failed to add account transaction log")
-
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failOnError(err, "Failed to add account transaction log")
-	}
+	writeDump(w, logging.ForCommand(r.Context(), "", req.TransactionNum, "DUMPLOG"), req.Filename, "", false)
 }
 
-func logErrorEventHandler(w http.ResponseWriter, r *http.Request) {
+func dumpUserLogHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	req := struct {
 		TransactionNum int
-		Server         string
-		Command        string
-		Username       string
-		Stock          string
 		Filename       string
-		ErrorMessage   string
-		Funds          float64
-	}{0, "", "", "", "", "", "", 0.0}
-
+		UserID         string
+	}{0, "", ""}
 	err := decoder.Decode(&req)
 	failOnError(err, "Failed to parse the request")
 
-	queryString := "INSERT INTO error_events (error_message, filename, funds, server, stock, timestamp, transaction_num, user_id)" +
-		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
-
-	timestamp := createTimestamp()
-
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare error events log query")
-
-	res, err := stmt.Exec(req.ErrorMessage, req.Filename, req.Funds, req.Server, req.Stock, timestamp, req.TransactionNum, req.Username)
-	failOnError(err, "Failed to add error events log")
+	writeDump(w, logging.ForCommand(r.Context(), req.UserID, req.TransactionNum, "DUMPLOG"), req.Filename, req.UserID, true)
+}
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failOnError(err, "Failed to add error events log")
+// Dumps the log and replies with whether it was written
+func writeDump(w http.ResponseWriter, logger *slog.Logger, filename string, username string, isUser bool) {
+	n, err := dumpLog(filename, username, isUser)
+	if err != nil {
+		logger.Error("Failed to dump log", "filename", filename, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	logger.Info("Dumped log", "filename", filename, "bytes", n)
 }
 
-func dumpLogHandler(w http.ResponseWriter, r *http.Request) {
+// Returns a user's most recent account transactions as JSON, newest first
+func userTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	req := struct {
-		Filename string
-	}{""}
+		UserID string
+		Limit  int
+	}{"", 0}
 	err := decoder.Decode(&req)
 	failOnError(err, "Failed to parse the request")
 
-	dumpLog(req.Filename, "", false)
-}
+	if req.Limit <= 0 {
+		req.Limit = 20
+	}
 
-func dumpUserLogHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+	queryString := "SELECT action, funds, server, timestamp, transaction_num, user_id FROM account_transactions" +
+		" WHERE user_id = $1 ORDER BY timestamp DESC LIMIT $2"
+	defer metrics.TimeQuery("account_transactions.list")()
+	rows, err := db.Query(queryString, req.UserID, req.Limit)
+	if err != nil {
+		logging.ForCommand(r.Context(), req.UserID, 0, "").Error("Failed to get account transactions", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
 
-	req := struct {
-		Filename string
-		UserID   string
-	}{"", ""}
-	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
+	transactions := []AccountTransaction{}
+	for rows.Next() {
+		transaction := AccountTransaction{}
+		if err := rows.Scan(&transaction.Action, &transaction.Funds, &transaction.Server, &transaction.Timestamp,
+			&transaction.TransactionNum, &transaction.Username); err != nil {
+			logging.ForCommand(r.Context(), req.UserID, 0, "").Error("Failed to read account transaction", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, transaction)
+	}
 
-	dumpLog(req.Filename, req.UserID, true)
+	payload, _ := json.Marshal(transactions)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
 }
 
-func dumpLog(filename string, username string, isUser bool) {
+// Writes the log, or only the user's part of it, to an XML file
+// Returns the number of bytes of events written
+func dumpLog(filename string, username string, isUser bool) (int, error) {
+	dumps.Add(1)
+	defer dumps.Done()
+
 	userquery := " LIMIT 1000000"
 	if isUser {
 		userquery = " WHERE user_id = '" + username + "' LIMIT 1000000"
@@ -362,8 +449,11 @@ func dumpLog(filename string, username string, isUser bool) {
 
 	// Get usercommands
 	queryString := "SELECT * FROM user_commands" + userquery
+	timeQuery := metrics.TimeQuery("user_commands.dump")
 	rows, err := db.Query(queryString)
-	failOnError(err, "Failed to prepare query")
+	if err != nil {
+		return 0, err
+	}
 	defer rows.Close()
 	
 	for rows.Next() {
@@ -372,18 +462,21 @@ func dumpLog(filename string, username string, isUser bool) {
 
 		if err := rows.Scan(&logEvent.Command, &logEvent.Filename, &logEvent.Funds, &logEvent.Server,
 			&logEvent.StockSymbol, &logEvent.Timestamp, &logEvent.TransactionNum, &logEvent.Username); err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
 
 		logs = append(logs, logEvent)
 	}
+	timeQuery()
 
-	fmt.Println(len(logs))
 	// Get systemevents
 	queryString = "SELECT * FROM system_events" + userquery
 
+	timeQuery = metrics.TimeQuery("system_events.dump")
 	rows, err = db.Query(queryString)
-	failOnError(err, "Failed to prepare query")
+	if err != nil {
+		return 0, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
@@ -391,17 +484,21 @@ func dumpLog(filename string, username string, isUser bool) {
 
 		if err := rows.Scan(&logEvent.Command, &logEvent.Filename, &logEvent.Funds, &logEvent.Server,
 			&logEvent.StockSymbol, &logEvent.Timestamp, &logEvent.TransactionNum, &logEvent.Username); err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
 
 		logs = append(logs, logEvent)
 	}
+	timeQuery()
 
 	// Get quoteserver
 	queryString = "SELECT * FROM quote_server_events" + userquery
 
+	timeQuery = metrics.TimeQuery("quote_server_events.dump")
 	rows, err = db.Query(queryString)
-	failOnError(err, "Failed to prepare query")
+	if err != nil {
+		return 0, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
@@ -409,17 +506,21 @@ func dumpLog(filename string, username string, isUser bool) {
 
 		if err := rows.Scan(&logEvent.CryptoKey, &logEvent.Price, &logEvent.QuoteServerTime,
 			&logEvent.Server, &logEvent.StockSymbol, &logEvent.Timestamp, &logEvent.TransactionNum, &logEvent.Username); err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
 
 		logs = append(logs, logEvent)
 	}
+	timeQuery()
 
 	// Get accounttransactions
 	queryString = "SELECT * FROM account_transactions" + userquery
 
+	timeQuery = metrics.TimeQuery("account_transactions.dump")
 	rows, err = db.Query(queryString)
-	failOnError(err, "Failed to prepare query")
+	if err != nil {
+		return 0, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
@@ -427,29 +528,34 @@ func dumpLog(filename string, username string, isUser bool) {
 
 		if err := rows.Scan(&logEvent.Action, &logEvent.Funds, &logEvent.Server, &logEvent.Timestamp,
 			&logEvent.TransactionNum, &logEvent.Username); err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
 
 		logs = append(logs, logEvent)
 	}
+	timeQuery()
 
 	// Get errorevents
-	queryString = "SELECT * FROM error_events" + userquery
+	queryString = "SELECT command, error_message, filename, funds, server, stock, timestamp, transaction_num, user_id FROM error_events" + userquery
 
+	timeQuery = metrics.TimeQuery("error_events.dump")
 	rows, err = db.Query(queryString)
-	failOnError(err, "Failed to prepare query")
+	if err != nil {
+		return 0, err
+	}
 	defer rows.Close()
 
 	for rows.Next() {
 		logEvent := ErrorEvent{}
 
-		if err := rows.Scan(&logEvent.ErrorMessage, &logEvent.Filename, &logEvent.Funds, &logEvent.Server,
+		if err := rows.Scan(&logEvent.Command, &logEvent.ErrorMessage, &logEvent.Filename, &logEvent.Funds, &logEvent.Server,
 			&logEvent.StockSymbol, &logEvent.Timestamp, &logEvent.TransactionNum, &logEvent.Username); err != nil {
-			log.Fatal(err)
+			return 0, err
 		}
 
 		logs = append(logs, logEvent)
 	}
+	timeQuery()
 
 	// Sort by timestamp then by transactionNum
 	sort.Slice(logs, func(i, j int) bool {
@@ -461,31 +567,60 @@ func dumpLog(filename string, username string, isUser bool) {
 
 	// Write to file
 	file, err := os.Create(filename)
-	failOnError(err, "File couldn't be created")
+	if err != nil {
+		return 0, err
+	}
 	defer file.Close()
 	file.Write([]byte("<?xml version=\"1.0\"?>\n"))
 	file.Write([]byte("<log>\n"))
 	test, err := xml.MarshalIndent(logs, "  ", "    ")
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
+		return 0, err
 	}
 
 	n1, err := file.Write(test)
-	file.Write([]byte("\n</log>"))
-	fmt.Printf("wrote %d bytes\n", n1)
-
-	failOnError(err, "Failed to write log files to XML")
-
+	if err != nil {
+		return n1, err
+	}
+	_, err = file.Write([]byte("\n</log>"))
+	return n1, err
 }
 
 func main() {
-	port := ":8081"
-	http.HandleFunc("/logUserCommand", logUserCommandHandler)
-	http.HandleFunc("/logSystemEvent", logSystemEventHandler)
-	http.HandleFunc("/logQuoteServer", logQuoteServerHandler)
-	http.HandleFunc("/logAccountTransaction", logAccountTransactionHandler)
-	http.HandleFunc("/logErrorEvent", logErrorEventHandler)
-	http.HandleFunc("/dumpLog", dumpLogHandler)
-	http.HandleFunc("/dumpUserLog", dumpUserLogHandler)
-	http.ListenAndServe(port, nil)
+	if len(settings.Args) > 0 && settings.Args[0] == "migrate" {
+		migrateCommand(settings.Args[1:])
+		return
+	}
+	settings.Print(os.Stdout)
+	flushTraces, err := tracing.Start("audit-server", cfg.TraceExporter, cfg.TraceTarget)
+	if err != nil {
+		slog.Error("Failed to start tracing", "error", err)
+		os.Exit(1)
+	}
+
+	port := ":" + strconv.Itoa(cfg.Port)
+	err = schema.Up()
+	failOnError(err, "Failed to migrate the audit database")
+
+	metrics.HandleFunc("/logUserCommand", logUserCommandHandler)
+	metrics.HandleFunc("/logSystemEvent", logSystemEventHandler)
+	metrics.HandleFunc("/logQuoteServer", logQuoteServerHandler)
+	metrics.HandleFunc("/logAccountTransaction", logAccountTransactionHandler)
+	metrics.HandleFunc("/logErrorEvent", logErrorEventHandler)
+	metrics.HandleFunc("/logBatch", logBatchHandler)
+	metrics.HandleFunc("/dumpLog", dumpLogHandler)
+	metrics.HandleFunc("/dumpUserLog", dumpUserLogHandler)
+	metrics.HandleFunc("/userTransactions", userTransactionsHandler)
+	http.HandleFunc("/healthz", health.Healthz)
+	http.HandleFunc("/readyz", health.Readyz(health.Check{Name: "crate", Check: pingDb}))
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/admin/log_level", logging.LevelHandler(cfg.AdminToken))
+	server := &http.Server{Addr: port, Handler: tracing.Middleware(http.DefaultServeMux)}
+	err = shutdown.ListenAndServe(server, cfg.ShutdownTimeout, func(ctx context.Context) {
+		// A dump cut off part way leaves a truncated file, so always let them finish
+		dumps.Wait()
+	}, flushTraces)
+	if err != nil {
+		slog.Error("Audit server stopped", "error", err)
+	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// An event that can be stored in one of the audit logs
+type auditEvent interface {
+	insert() error
+	logger(ctx context.Context) *slog.Logger
+}
+
+// The events /logBatch accepts, by the type they're sent with
+var auditEventTypes = map[string]func() auditEvent{
+	"userCommand":        func() auditEvent { return &userCommandRequest{} },
+	"systemEvent":        func() auditEvent { return &systemEventRequest{} },
+	"quoteServer":        func() auditEvent { return &quoteServerRequest{} },
+	"accountTransaction": func() auditEvent { return &accountTransactionRequest{} },
+	"errorEvent":         func() auditEvent { return &errorEventRequest{} },
+}
+
+// One event in a /logBatch request. Event is the body its single-event endpoint would take.
+type batchedEvent struct {
+	Type  string
+	Event json.RawMessage
+}
+
+// Stores a batch of events, in order, stopping at the first that fails. The reply says how many were stored,
+// so the sender can drop those and retry the rest without storing any of them twice:
+//
+//	200 {"Stored": 100}
+//	400 {"Stored": 12, "Error": "..."}	the 13th event is malformed and retrying it won't help
+//	500 {"Stored": 12, "Error": "..."}	the 13th event couldn't be stored right now
+func logBatchHandler(w http.ResponseWriter, r *http.Request) {
+	batch := []batchedEvent{}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeBatchResult(w, http.StatusBadRequest, 0, "Failed to parse the request: "+err.Error())
+		return
+	}
+
+	for i, e := range batch {
+		newEvent, ok := auditEventTypes[e.Type]
+		if !ok {
+			writeBatchResult(w, http.StatusBadRequest, i, "unknown event type "+e.Type)
+			return
+		}
+		event := newEvent()
+		if err := json.Unmarshal(e.Event, event); err != nil {
+			writeBatchResult(w, http.StatusBadRequest, i, "Failed to parse "+e.Type+" event: "+err.Error())
+			return
+		}
+		if err := event.insert(); err != nil {
+			event.logger(r.Context()).Error("Failed to add "+e.Type+" event from batch", "error", err)
+			writeBatchResult(w, http.StatusInternalServerError, i, err.Error())
+			return
+		}
+	}
+	writeBatchResult(w, http.StatusOK, len(batch), "")
+}
+
+func writeBatchResult(w http.ResponseWriter, status int, stored int, message string) {
+	payload, _ := json.Marshal(struct {
+		Stored int
+		Error  string `json:",omitempty"`
+	}{stored, message})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
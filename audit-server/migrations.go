@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/migrate"
+)
+
+// The audit database's schema, oldest first. Never edit a migration once it's been released; add a new one.
+// Migration 1 is the schema the service started with. Databases created before migrations existed already have
+// it, so it only creates what's missing and the migrations after it bring them up to date.
+var migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create tables",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS user_commands(
+				timestamp BIGINT,
+				transaction_num INTEGER,
+				server TEXT,
+				command TEXT,
+				stock TEXT,
+				filename TEXT,
+				funds FLOAT,
+				user_id TEXT
+			);`,
+			`CREATE TABLE IF NOT EXISTS system_events(
+				timestamp BIGINT,
+				transaction_num INTEGER,
+				server TEXT,
+				user_id TEXT,
+				command TEXT,
+				stock TEXT,
+				filename TEXT,
+				funds FLOAT
+			);`,
+			`CREATE TABLE IF NOT EXISTS quote_server_events(
+				timestamp BIGINT,
+				transaction_num INTEGER,
+				server TEXT,
+				user_id TEXT,
+				stock TEXT,
+				crypto_key TEXT,
+				quote_server_time BIGINT,
+				price FLOAT
+			);`,
+			`CREATE TABLE IF NOT EXISTS account_transactions(
+				timestamp BIGINT,
+				server TEXT,
+				transaction_num INTEGER,
+				action TEXT,
+				user_id TEXT,
+				funds FLOAT
+			);`,
+			`CREATE TABLE IF NOT EXISTS error_events(
+				timestamp BIGINT,
+				server TEXT,
+				transaction_num INTEGER,
+				user_id TEXT,
+				stock TEXT,
+				filename TEXT,
+				error_message TEXT,
+				funds FLOAT
+			);`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS error_events;",
+			"DROP TABLE IF EXISTS account_transactions;",
+			"DROP TABLE IF EXISTS quote_server_events;",
+			"DROP TABLE IF EXISTS system_events;",
+			"DROP TABLE IF EXISTS user_commands;",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add error event command",
+		Up: []string{
+			"ALTER TABLE error_events ADD COLUMN command TEXT;",
+		},
+		Down: []string{
+			"ALTER TABLE error_events DROP COLUMN command;",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "store money in cents",
+		Up: convertMoney("BIGINT", func(column string) string {
+			return "CAST(ROUND(" + column + " * 100) AS BIGINT)"
+		}),
+		Down: convertMoney("FLOAT", func(column string) string {
+			return "CAST(" + column + " AS FLOAT) / 100"
+		}),
+	},
+}
+
+// Returns the statements that change the type of every audit table's money columns
+// Parameters:
+// 		moneyType: 	the type the money columns are changed to
+// 		from:		returns the expression that converts a money column to the new type
+//
+func convertMoney(moneyType string, from func(column string) string) []string {
+	moneyColumn := func(name string) migrate.Column {
+		return migrate.Column{Name: name, Type: moneyType, From: from(name)}
+	}
+	return migrate.Join(
+		migrate.ConvertTable("user_commands", []migrate.Column{
+			{Name: "timestamp", Type: "BIGINT"},
+			{Name: "transaction_num", Type: "INTEGER"},
+			{Name: "server", Type: "TEXT"},
+			{Name: "command", Type: "TEXT"},
+			{Name: "stock", Type: "TEXT"},
+			{Name: "filename", Type: "TEXT"},
+			moneyColumn("funds"),
+			{Name: "user_id", Type: "TEXT"},
+		}, ""),
+		migrate.ConvertTable("system_events", []migrate.Column{
+			{Name: "timestamp", Type: "BIGINT"},
+			{Name: "transaction_num", Type: "INTEGER"},
+			{Name: "server", Type: "TEXT"},
+			{Name: "user_id", Type: "TEXT"},
+			{Name: "command", Type: "TEXT"},
+			{Name: "stock", Type: "TEXT"},
+			{Name: "filename", Type: "TEXT"},
+			moneyColumn("funds"),
+		}, ""),
+		migrate.ConvertTable("quote_server_events", []migrate.Column{
+			{Name: "timestamp", Type: "BIGINT"},
+			{Name: "transaction_num", Type: "INTEGER"},
+			{Name: "server", Type: "TEXT"},
+			{Name: "user_id", Type: "TEXT"},
+			{Name: "stock", Type: "TEXT"},
+			{Name: "crypto_key", Type: "TEXT"},
+			{Name: "quote_server_time", Type: "BIGINT"},
+			moneyColumn("price"),
+		}, ""),
+		migrate.ConvertTable("account_transactions", []migrate.Column{
+			{Name: "timestamp", Type: "BIGINT"},
+			{Name: "server", Type: "TEXT"},
+			{Name: "transaction_num", Type: "INTEGER"},
+			{Name: "action", Type: "TEXT"},
+			{Name: "user_id", Type: "TEXT"},
+			moneyColumn("funds"),
+		}, ""),
+		migrate.ConvertTable("error_events", []migrate.Column{
+			{Name: "timestamp", Type: "BIGINT"},
+			{Name: "server", Type: "TEXT"},
+			{Name: "transaction_num", Type: "INTEGER"},
+			{Name: "user_id", Type: "TEXT"},
+			{Name: "stock", Type: "TEXT"},
+			{Name: "filename", Type: "TEXT"},
+			{Name: "error_message", Type: "TEXT"},
+			moneyColumn("funds"),
+			{Name: "command", Type: "TEXT"},
+		}, ""),
+	)
+}
+
+var schema = migrate.NewRunner(db, migrations, true)
+
+// Runs "audit-server migrate ..."
+func migrateCommand(args []string) {
+	if err := migrate.Command(schema, args); err != nil {
+		slog.Error("Failed to migrate", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Produces the price of a single stock. Every call to Next advances the model by one step.
+type PriceModel interface {
+	Next() float64
+}
+
+// A price that moves up or down by a random percentage each step
+type randomWalkModel struct {
+	rand       *rand.Rand
+	price      float64
+	volatility float64 // largest fractional move in a single step
+	started    bool
+}
+
+// Creates a random walk for a symbol. The walk only depends on the seed and the symbol, so the same
+// seed always reproduces the same prices.
+// Parameters:
+// 		symbol: 		the symbol of the stock the model prices
+// 		seed:			the seed shared by the whole market
+// 		start:			the first price to return. If 0, a price between $10 and $500 is derived from the symbol
+// 		volatility:		the largest fractional move in a single step, e.g. 0.02 for 2%
+//
+func newRandomWalkModel(symbol string, seed int64, start float64, volatility float64) *randomWalkModel {
+	h := fnv.New64a()
+	h.Write([]byte(symbol))
+	sum := h.Sum64()
+
+	if start <= 0 {
+		start = 10 + float64(sum%49000)/100
+	}
+	return &randomWalkModel{
+		rand:       rand.New(rand.NewSource(seed ^ int64(sum))),
+		price:      start,
+		volatility: volatility,
+	}
+}
+
+func (m *randomWalkModel) Next() float64 {
+	if m.started {
+		step := (m.rand.Float64()*2 - 1) * m.volatility
+		m.price = math.Max(0.01, m.price*(1+step))
+	}
+	m.started = true
+	return math.Round(m.price*100) / 100
+}
+
+// Plays back a fixed list of prices, starting over once it reaches the end
+type scriptedModel struct {
+	prices []float64
+	next   int
+}
+
+func (m *scriptedModel) Next() float64 {
+	price := m.prices[m.next]
+	m.next = (m.next + 1) % len(m.prices)
+	return price
+}
+
+// Parses scripted prices given as "ABC=10,10.5,11;XYZ=3.25,3"
+func parseScripts(script string) (map[string]*scriptedModel, error) {
+	models := map[string]*scriptedModel{}
+	if strings.TrimSpace(script) == "" {
+		return models, nil
+	}
+
+	for _, entry := range strings.Split(script, ";") {
+		spl := strings.SplitN(entry, "=", 2)
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("invalid script %q, expected SYMBOL=price,price,...", entry)
+		}
+		symbol := strings.TrimSpace(spl[0])
+		for _, p := range strings.Split(spl[1], ",") {
+			price, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid price %q for %s: %s", p, symbol, err)
+			}
+			addScriptedPrice(models, symbol, price)
+		}
+	}
+	return models, nil
+}
+
+// Loads scripted prices from a CSV file with rows of "symbol,price".
+// The rows for each symbol are played back in the order they appear. A header row is skipped.
+func loadCSV(filename string) (map[string]*scriptedModel, error) {
+	models := map[string]*scriptedModel{}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		price, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: invalid price %q", filename, line, record[1])
+		}
+		addScriptedPrice(models, strings.TrimSpace(record[0]), price)
+	}
+	return models, nil
+}
+
+func addScriptedPrice(models map[string]*scriptedModel, symbol string, price float64) {
+	model, ok := models[symbol]
+	if !ok {
+		model = &scriptedModel{}
+		models[symbol] = model
+	}
+	model.prices = append(model.prices, price)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A stand-in for the legacy quote server. It speaks the same protocol over TCP:
+// the client sends "SYMBOL,USERID\r" and gets back "price,symbol,user,timestamp,cryptokey\n".
+//
+// Symbols given a script (-script) or listed in a CSV file (-csv) play back those prices.
+// Every other symbol follows a random walk seeded by -seed, so runs are reproducible.
+
+var (
+	addr       = flag.String("addr", ":4452", "address to listen on")
+	seed       = flag.Int64("seed", 1, "seed for random walk prices and crypto keys")
+	start      = flag.Float64("start", 0, "starting price for random walks (0 derives one from each symbol)")
+	volatility = flag.Float64("volatility", 0.02, "largest fractional price move per quote for random walks")
+	script     = flag.String("script", "", "scripted prices, e.g. \"ABC=10,10.5,11;XYZ=3.25,3\"")
+	csvFile    = flag.String("csv", "", "CSV file of symbol,price rows to play back")
+)
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		fmt.Printf("%s: %s\n", msg, err)
+		panic(err)
+	}
+}
+
+// All of the stocks the quote server knows about
+type market struct {
+	mu     sync.Mutex
+	models map[string]PriceModel
+	rand   *rand.Rand
+}
+
+// Returns the next price for a symbol and a crypto key for the quote
+func (m *market) quote(symbol string) (float64, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	model, ok := m.models[symbol]
+	if !ok {
+		model = newRandomWalkModel(symbol, *seed, *start, *volatility)
+		m.models[symbol] = model
+	}
+
+	key := make([]byte, 22)
+	m.rand.Read(key)
+	return model.Next(), hex.EncodeToString(key)
+}
+
+// Splits requests on "\r" like the legacy quote server, but also accepts "\n" so it can be used from netcat
+func scanRequests(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Answers quote requests on a connection until the client closes it
+func handleConnection(conn net.Conn, m *market) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(scanRequests)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		spl := strings.Split(line, ",")
+		if len(spl) != 2 || spl[0] == "" {
+			fmt.Fprintf(conn, "error: expected SYMBOL,USERID\n")
+			continue
+		}
+		symbol, userID := spl[0], spl[1]
+
+		price, cryptoKey := m.quote(symbol)
+		timestamp := time.Now().UTC().UnixNano() / int64(time.Millisecond)
+		fmt.Fprintf(conn, "%.2f,%s,%s,%d,%s\n", price, symbol, userID, timestamp, cryptoKey)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	m := &market{
+		models: map[string]PriceModel{},
+		rand:   rand.New(rand.NewSource(*seed)),
+	}
+
+	scripts, err := parseScripts(*script)
+	failOnError(err, "Failed to parse scripted prices")
+	for symbol, model := range scripts {
+		m.models[symbol] = model
+	}
+
+	if *csvFile != "" {
+		prices, err := loadCSV(*csvFile)
+		failOnError(err, "Failed to load CSV prices")
+		for symbol, model := range prices {
+			m.models[symbol] = model
+		}
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	failOnError(err, "Failed to listen")
+	fmt.Printf("quote server listening on %s\n", *addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Failed to accept connection: %s\n", err)
+			continue
+		}
+		go handleConnection(conn, m)
+	}
+}
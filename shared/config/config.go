@@ -0,0 +1,282 @@
+// Package config loads a service's settings from defaults, a config file, environment variables and
+// command line flags, in that order of precedence.
+//
+// Settings are the fields of a struct tagged with their name:
+//
+//	type settings struct {
+//		Port     int           `config:"port" default:"8080" help:"port to listen on"`
+//		Interval time.Duration `config:"trigger_interval" default:"10s"`
+//	}
+//
+// A setting named "redis_addr" is read from the "redis_addr" key of the JSON config file, the REDIS_ADDR
+// environment variable and the -redis-addr flag. The config file is given by the -config flag or the
+// CONFIG_FILE environment variable. Supported types are string, bool, int, int64 and time.Duration.
+// Settings tagged secret:"true", e.g. tokens, are hidden when the settings are printed.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implemented by settings structs that check their values once they're loaded
+type Validator interface {
+	Validate() error
+}
+
+type setting struct {
+	name   string
+	help   string
+	value  reflect.Value
+	source string // where the value came from: "default", "file", "env" or "flag"
+	secret bool   // hidden when printed
+}
+
+func (s *setting) env() string {
+	return strings.ToUpper(s.name)
+}
+
+func (s *setting) flag() string {
+	return strings.Replace(s.name, "_", "-", -1)
+}
+
+func (s *setting) set(raw string, source string) error {
+	v := s.value
+	var err error
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		var d time.Duration
+		d, err = time.ParseDuration(raw)
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(raw)
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(raw, 10, 64)
+		v.SetInt(i)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", s.name, v.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %q from %s", s.name, raw, source)
+	}
+	s.source = source
+	return nil
+}
+
+// The settings a service loaded
+type Loaded struct {
+	settings []*setting
+
+	// Command line arguments left over after the flags
+	Args []string
+}
+
+// Loads a service's settings
+// Parameters:
+// 		cfg: 		pointer to the settings struct to fill in
+// 		service:	the name of the service, used in flag usage messages
+// 		args:		the command line arguments, without the program name
+//
+// Returns the loaded settings, or an error if any of them are invalid
+func Load(cfg interface{}, service string, args []string) (*Loaded, error) {
+	rv := reflect.ValueOf(cfg)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config: expected a pointer to a struct, got %T", cfg)
+	}
+
+	loaded := &Loaded{}
+	byName := map[string]*setting{}
+	st := rv.Elem().Type()
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Field(i)
+		name := field.Tag.Get("config")
+		if name == "" {
+			continue
+		}
+		s := &setting{name, field.Tag.Get("help"), rv.Elem().Field(i), "default", field.Tag.Get("secret") == "true"}
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := s.set(def, "default"); err != nil {
+				return nil, err
+			}
+		}
+		loaded.settings = append(loaded.settings, s)
+		byName[name] = s
+	}
+
+	// Parse the flags first to find the config file, but apply them last so they win
+	fs := flag.NewFlagSet(service, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	flags := map[string]*string{}
+	for _, s := range loaded.settings {
+		flags[s.name] = fs.String(s.flag(), "", s.help+" (env "+s.env()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	loaded.Args = fs.Args()
+
+	if *configFile != "" {
+		if err := loaded.loadFile(*configFile, byName); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range loaded.settings {
+		if raw, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(raw, "env"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range loaded.settings {
+			if s.flag() == f.Name && err == nil {
+				err = s.set(*flags[s.name], "flag")
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+func (l *Loaded) loadFile(path string, byName map[string]*setting) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+
+	for name, value := range values {
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("config: %s: unknown setting %q", path, name)
+		}
+		// Strings are unquoted, and numbers and bools are used as they're written
+		raw := string(value)
+		var str string
+		if json.Unmarshal(value, &str) == nil {
+			raw = str
+		}
+		if err := s.set(raw, "file"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prints every setting's effective value and where it came from. Secrets and passwords in URLs are hidden.
+func (l *Loaded) Print(w io.Writer) {
+	for _, s := range l.settings {
+		value := fmt.Sprint(s.value.Interface())
+		if s.secret && value != "" {
+			value = "xxxxx"
+		}
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "xxxxx")
+				value = u.String()
+			}
+		}
+		fmt.Fprintf(w, "%-20s %-40s (%s)\n", s.name, value, s.source)
+	}
+}
+
+// Returns an error unless the port can be listened on
+func CheckPort(name string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s: port %d is out of range", name, port)
+	}
+	return nil
+}
+
+// Returns an error unless the value is an absolute URL with one of the given schemes
+func CheckURL(name string, value string, schemes ...string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%s: %q is not an absolute URL", name, value)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %q must use one of %v", name, value, schemes)
+}
+
+// Returns an error unless the value is a host:port address
+func CheckHostPort(name string, value string) error {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("%s: %q is not a host:port address", name, value)
+	}
+	return nil
+}
+
+// Returns an error unless the duration is positive
+func CheckPositive(name string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%s: %s must be positive", name, d)
+	}
+	return nil
+}
+
+// Returns an error unless the number is at least min
+func CheckAtLeast(name string, value int, min int) error {
+	if value < min {
+		return fmt.Errorf("%s: %d must be at least %d", name, value, min)
+	}
+	return nil
+}
+
+// Returns an error unless the value is one of the options
+func CheckOneOf(name string, value string, options ...string) error {
+	for _, option := range options {
+		if value == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %q must be one of %v", name, value, options)
+}
+
+// Combines the errors from several checks into one, ignoring the checks that passed
+func Check(errs ...error) error {
+	msgs := []string{}
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New("invalid config: " + strings.Join(msgs, "; "))
+}
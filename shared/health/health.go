@@ -0,0 +1,128 @@
+// Package health serves the /healthz and /readyz endpoints every service exposes.
+//
+// /healthz only says the process is up and serving. /readyz checks each of the service's dependencies,
+// in parallel, and replies 200 if they're all usable or 503 if any of them aren't. Either way the body
+// reports every dependency's status and how long its check took:
+//
+//	{"Status": "error", "Dependencies": {
+//		"crate": {"Status": "ok", "LatencyMs": 1.4},
+//		"redis": {"Status": "error", "LatencyMs": 2000.3, "Error": "context deadline exceeded"}}}
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long a dependency has to answer before it's reported as unavailable
+const checkTimeout = 2 * time.Second
+
+// Checks whether a single dependency is usable
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// The result of checking a single dependency
+type DependencyStatus struct {
+	Status    string  // "ok" or "error"
+	LatencyMs float64 // how long the check took
+	Error     string  `json:",omitempty"`
+}
+
+// The body of a /healthz or /readyz response
+type Report struct {
+	Status       string                      // "ok" or "error"
+	Dependencies map[string]DependencyStatus `json:",omitempty"`
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	payload, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
+// Replies that the process is up. Never checks dependencies, so a slow database can't get the process restarted.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: "ok"})
+}
+
+// Returns a handler that checks every dependency and replies with their statuses
+func Readyz(checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, Run(r.Context(), checks...))
+	}
+}
+
+// Checks every dependency in parallel
+func Run(ctx context.Context, checks ...Check) Report {
+	report := Report{Status: "ok", Dependencies: map[string]DependencyStatus{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c Check) {
+			defer wg.Done()
+			status := run(ctx, c)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[c.Name] = status
+			if status.Status != "ok" {
+				report.Status = "error"
+			}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+func run(ctx context.Context, c Check) (status DependencyStatus) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		// A check that panics means the dependency isn't usable, not that the service is down
+		if p := recover(); p != nil {
+			status.Status = "error"
+			status.Error = fmt.Sprint(p)
+		}
+	}()
+
+	if err := c.Check(ctx); err != nil {
+		return DependencyStatus{Status: "error", Error: err.Error()}
+	}
+	return DependencyStatus{Status: "ok"}
+}
+
+// Returns a check that GETs the URL and expects a 200, e.g. another service's /readyz
+func HTTPCheck(name string, url string) Check {
+	return Check{name, func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", url, res.Status)
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,112 @@
+// Package logging writes every service's diagnostics as JSON lines on stdout, through log/slog.
+//
+// Each line has the time, level, service and message. Lines about a command also carry the user,
+// transaction number and command it was for, and the trace it's part of, so a user's or a transaction's
+// lines can be found with grep:
+//
+//	{"time":"...","level":"ERROR","msg":"Failed to buy stock","service":"transaction-server",
+//		"user":"oY01WVirLr","transaction_num":42,"command":"BUY","trace_id":"...","error":"..."}
+//
+// The level starts at the service's log_level setting and can be changed while it runs through
+// LevelHandler. The handler only answers requests carrying the service's admin_token, so it can be served
+// on the same port as the service's commands.
+package logging
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The levels a service can log at, from most to least verbose
+var Levels = []string{"debug", "info", "warn", "error"}
+
+// Lines below this level are dropped
+var level = new(slog.LevelVar)
+
+// Makes the default slog logger write JSON lines tagged with the service. Should be called before
+// anything is logged, so even a config that fails to load is reported as JSON.
+func Init(service string) {
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler).With("service", service))
+}
+
+// Sets the lowest level that's logged, one of Levels
+func SetLevel(name string) error {
+	return level.UnmarshalText([]byte(name))
+}
+
+// Returns a logger for lines about a command. Empty fields are left out.
+// Parameters:
+// 		ctx: 			the context the command runs in. The trace it's part of is added.
+// 		UserID: 		id of the user who sent the command
+// 		transactionNum:	the command's transaction number
+// 		command:		the name of the command, e.g. "BUY"
+//
+func ForCommand(ctx context.Context, UserID string, transactionNum int, command string) *slog.Logger {
+	attrs := []any{}
+	if UserID != "" {
+		attrs = append(attrs, "user", UserID)
+	}
+	if transactionNum != 0 {
+		attrs = append(attrs, "transaction_num", transactionNum)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		attrs = append(attrs, "trace_id", sc.TraceID().String())
+	}
+	if command != "" {
+		attrs = append(attrs, "command", command)
+	}
+	return slog.Default().With(attrs...)
+}
+
+// Returns a handler that reports the current log level on GET, and changes it on PUT or POST with a body
+// of {"Level": "debug"}. Requests must send the token as "Authorization: Bearer <token>". With no token
+// the handler is disabled and answers every request with 404.
+func LevelHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		sent := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			req := struct {
+				Level string
+			}{""}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Failed to parse the request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := SetLevel(req.Level); err != nil {
+				http.Error(w, "Level must be one of "+strings.Join(Levels, ", "), http.StatusBadRequest)
+				return
+			}
+			slog.Warn("Changed log level", "level", strings.ToLower(level.Level().String()))
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, _ := json.Marshal(struct {
+			Level string
+		}{strings.ToLower(level.Level().String())})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	}
+}
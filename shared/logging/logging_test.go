@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLevelHandlerNeedsToken(t *testing.T) {
+	defer SetLevel("info")
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+		level  string
+	}{
+		{"disabled without a token", "", "Bearer ", http.StatusNotFound, "info"},
+		{"rejects a missing token", "secret", "", http.StatusUnauthorized, "info"},
+		{"rejects the wrong token", "secret", "Bearer guess", http.StatusUnauthorized, "info"},
+		{"changes the level with the token", "secret", "Bearer secret", http.StatusOK, "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetLevel("info")
+			r := httptest.NewRequest(http.MethodPut, "/admin/log_level", strings.NewReader(`{"Level": "debug"}`))
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			LevelHandler(tt.token)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("replied %d, want %d", w.Code, tt.status)
+			}
+			if got := strings.ToLower(level.Level().String()); got != tt.level {
+				t.Errorf("level = %s, want %s", got, tt.level)
+			}
+		})
+	}
+}
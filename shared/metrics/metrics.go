@@ -0,0 +1,90 @@
+// Package metrics holds the Prometheus metrics every service exposes on /metrics.
+//
+// Each command route is registered with HandleFunc, which counts its requests by status code and records
+// how long they took. Services register their own metrics with promauto, under the same namespace.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prefixes the name of every metric
+const Namespace = "daytrading"
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests handled, by route and status code.",
+	}, []string{"route", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "How long requests took to handle, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "How long database queries took, by query.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+// Serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Records the status code a handler replied with
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Wraps a handler so its requests are counted and timed under the route
+func Instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	duration := requestDuration.WithLabelValues(route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{w, http.StatusOK}
+		defer func() {
+			// A handler that panics is counted as a 500, then left for net/http to recover from
+			if p := recover(); p != nil {
+				rec.code = http.StatusInternalServerError
+				defer panic(p)
+			}
+			duration.Observe(time.Since(start).Seconds())
+			requests.WithLabelValues(route, strconv.Itoa(rec.code)).Inc()
+		}()
+		h(rec, r)
+	}
+}
+
+// Registers an instrumented handler for the route on the default ServeMux
+func HandleFunc(route string, h http.HandlerFunc) {
+	http.HandleFunc(route, Instrument(route, h))
+}
+
+// Starts timing a database query. Call the returned function once the query's results have been read:
+//
+//	defer metrics.TimeQuery("users.balance")()
+func TimeQuery(query string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	}
+}
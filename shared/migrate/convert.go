@@ -0,0 +1,78 @@
+package migrate
+
+import "strings"
+
+// A column of a table that ConvertTable is changing
+type Column struct {
+	Name string // its name after the change
+	Type string // its type after the change, e.g. "BIGINT"
+
+	// The expression that computes it from the table's old columns, e.g. "CAST(ROUND(price * 100) AS BIGINT)".
+	// Empty if it's copied as it is.
+	From string
+}
+
+// Returns the statements that change a table's columns, e.g. their types. Neither database can change a
+// column's type in place, so the rows are copied into a new table, the table is created again with the
+// new columns, and the rows are copied back. The rows are always in at least one of the two tables, and
+// every statement is safe to run twice in a row, so a migration built from them can resume after a crash.
+// Parameters:
+// 		table: 			the table to change
+// 		columns:		every column the table has after the change
+// 		primaryKey:		the table's primary key columns, e.g. "user_id, symbol". Empty if it has none
+//
+func ConvertTable(table string, columns []Column, primaryKey string) []string {
+	copyTable := table + "_converted"
+
+	definitions := []string{}
+	names := []string{}
+	from := []string{}
+	for _, c := range columns {
+		definitions = append(definitions, c.Name+" "+c.Type)
+		names = append(names, c.Name)
+		if c.From != "" {
+			from = append(from, c.From)
+		} else {
+			from = append(from, c.Name)
+		}
+	}
+	if primaryKey != "" {
+		definitions = append(definitions, "PRIMARY KEY ("+primaryKey+")")
+	}
+
+	create := func(name string) string {
+		return "CREATE TABLE IF NOT EXISTS " + name + "(" + strings.Join(definitions, ", ") + ");"
+	}
+	// Rows copied before an interrupted copy are skipped when it runs again. Without a primary key
+	// there's nothing to tell them apart, so an interrupted copy can only be resumed on a database with
+	// transactions, where it copies everything or nothing.
+	copyRows := func(to string, selected []string, source string) string {
+		statement := "INSERT INTO " + to + " (" + strings.Join(names, ", ") + ") (SELECT " +
+			strings.Join(selected, ", ") + " FROM " + source + ")"
+		if primaryKey != "" {
+			statement += " ON CONFLICT DO NOTHING"
+		}
+		return statement + ";"
+	}
+
+	return []string{
+		create(copyTable),
+		"REFRESH TABLE " + table + ";",
+		copyRows(copyTable, from, table),
+		"REFRESH TABLE " + copyTable + ";",
+		"DROP TABLE IF EXISTS " + table + ";",
+		create(table),
+		copyRows(table, names, copyTable),
+		"REFRESH TABLE " + table + ";",
+		"DROP TABLE IF EXISTS " + copyTable + ";",
+	}
+}
+
+// Joins lists of statements, e.g. from several calls to ConvertTable, into one
+func Join(lists ...[]string) []string {
+	statements := []string{}
+	for _, list := range lists {
+		statements = append(statements, list...)
+	}
+	return statements
+}
@@ -0,0 +1,95 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	// How long a lock can go without a heartbeat before another process takes it over. A heartbeat is sent
+	// after every statement, so this has to outlast the slowest one, e.g. copying a large audit table.
+	lockTimeout = 30 * time.Minute
+
+	// How often a process waiting for the lock checks whether it's free
+	lockPollInterval = time.Second
+)
+
+var errLockLost = errors.New("another process took over the migration lock")
+
+// The row in schema_lock a runner holds while it migrates
+type lock struct {
+	r     *Runner
+	owner string
+}
+
+func now() int64 {
+	return time.Now().UTC().UnixNano() / int64(time.Millisecond)
+}
+
+// Takes the migration lock, waiting for any other process holding it to finish.
+// A lock whose holder hasn't sent a heartbeat for lockTimeout is assumed abandoned and taken over.
+func (r *Runner) lock() (*lock, error) {
+	host, _ := os.Hostname()
+	l := &lock{r, fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())}
+
+	waiting := false
+	free := 0
+	for {
+		insertErr := r.exec("INSERT INTO schema_lock (id, owner, heartbeat) VALUES (1, $1, $2);", l.owner, now())
+		if insertErr == nil {
+			return l, nil
+		}
+
+		// Most likely another process holds the lock, so find out which
+		var owner string
+		var heartbeat int64
+		err := r.DB.QueryRow("SELECT owner, heartbeat FROM schema_lock WHERE id = 1;").Scan(&owner, &heartbeat)
+		if err == sql.ErrNoRows {
+			// Released in the meantime. If it's still free next time, the insert failed for another reason
+			free++
+			if free > 1 {
+				return nil, insertErr
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		free = 0
+
+		if now()-heartbeat > int64(lockTimeout/time.Millisecond) {
+			slog.Warn("Taking over an abandoned migration lock", "owner", owner)
+			if err := r.exec("DELETE FROM schema_lock WHERE id = 1 AND owner = $1;", owner); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !waiting {
+			slog.Info("Waiting for another process to finish migrating", "owner", owner)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Tells waiting processes the lock's holder is still working. Fails if another process took it over.
+func (l *lock) heartbeat() error {
+	res, err := l.r.DB.Exec("UPDATE schema_lock SET heartbeat = $1 WHERE id = 1 AND owner = $2;", now(), l.owner)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errLockLost
+	}
+	return nil
+}
+
+func (l *lock) release() {
+	if err := l.r.exec("DELETE FROM schema_lock WHERE id = 1 AND owner = $1;", l.owner); err != nil {
+		slog.Error("Failed to release the migration lock", "error", err)
+	}
+}
@@ -0,0 +1,304 @@
+// Package migrate applies versioned schema migrations to the services' databases.
+//
+// Each migration has a version, and the versions that have been applied are recorded in the
+// schema_version table. Up applies every migration that hasn't been applied yet, in version order,
+// and Down reverts applied migrations newest first. Statements are written in SQL that both CrateDB
+// and PostgreSQL accept.
+//
+// CrateDB has no transactions, so a migration that fails part way is not rolled back. Instead, the
+// runner records each statement of a migration as it completes in the schema_progress table, and the
+// next run carries on after the last one that completed. The statement that was interrupted is run
+// again, so every statement must be safe to run twice in a row (CREATE TABLE IF NOT EXISTS,
+// DROP TABLE IF EXISTS, ON CONFLICT DO NOTHING). ConvertTable builds statements like that for changing
+// a table's columns.
+//
+// Only one process migrates a database at a time. Up and Down hold a lock row in the schema_lock
+// table while they run, and wait for any other process holding it to finish.
+//
+// A migration that copies data between tables can REFRESH TABLE the copy before reading it; those
+// statements are skipped on databases that don't need them.
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errIrreversible = errors.New("migration can't be reverted")
+
+// A single change to a database's schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string // statements that apply the migration
+	Down    []string // statements that revert it. Empty if it can't be reverted
+}
+
+// Applies a service's migrations to its database
+type Runner struct {
+	DB         *sql.DB
+	Migrations []Migration
+
+	// CrateDB only makes writes visible to queries after the table is refreshed
+	Refresh bool
+}
+
+// Creates a runner. Migrations are sorted by version.
+// Parameters:
+// 		db: 			the database to migrate
+// 		migrations:		every migration the service has
+// 		refresh:		whether the database needs REFRESH TABLE before it can read its own writes (CrateDB)
+//
+func NewRunner(db *sql.DB, migrations []Migration, refresh bool) *Runner {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Runner{db, sorted, refresh}
+}
+
+func (r *Runner) exec(statement string, args ...interface{}) error {
+	_, err := r.DB.Exec(statement, args...)
+	if err != nil {
+		return fmt.Errorf("migrate: %s: %w", statement, err)
+	}
+	return nil
+}
+
+// Runs one of a migration's statements
+func (r *Runner) run(statement string) error {
+	if !r.Refresh && strings.HasPrefix(strings.ToUpper(strings.TrimSpace(statement)), "REFRESH TABLE") {
+		return nil
+	}
+	return r.exec(statement)
+}
+
+func (r *Runner) ensureTables() error {
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name TEXT, applied_at BIGINT);",
+		"CREATE TABLE IF NOT EXISTS schema_progress (version INTEGER PRIMARY KEY, direction TEXT, step INTEGER);",
+		"CREATE TABLE IF NOT EXISTS schema_lock (id INTEGER PRIMARY KEY, owner TEXT, heartbeat BIGINT);",
+	} {
+		if err := r.exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runner) refresh(table string) error {
+	if !r.Refresh {
+		return nil
+	}
+	return r.exec("REFRESH TABLE " + table + ";")
+}
+
+// Returns the versions that have been applied
+func (r *Runner) applied() (map[int]bool, error) {
+	if err := r.ensureTables(); err != nil {
+		return nil, err
+	}
+	if err := r.refresh("schema_version"); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.DB.Query("SELECT version FROM schema_version;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions[version] = true
+	}
+	return versions, rows.Err()
+}
+
+// Returns the newest version that has been applied, or 0 if none have
+func (r *Runner) Version() (int, error) {
+	versions, err := r.applied()
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for version := range versions {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// Returns how many of a migration's statements have already been run in the given direction
+func (r *Runner) progress(version int, direction string) (int, error) {
+	var recorded string
+	var step int
+	err := r.DB.QueryRow("SELECT direction, step FROM schema_progress WHERE version = $1;", version).Scan(&recorded, &step)
+	if err == sql.ErrNoRows || (err == nil && recorded != direction) {
+		return 0, nil
+	}
+	return step, err
+}
+
+// Runs the statements of a migration in one direction, starting after the last one a previous run completed
+// Parameters:
+// 		m: 				the migration
+// 		direction:		"up" or "down"
+// 		statements:		the migration's statements in that direction
+// 		l:				the lock the runner holds
+//
+func (r *Runner) step(m Migration, direction string, statements []string, l *lock) error {
+	done, err := r.progress(m.Version, direction)
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		slog.Info("Resuming migration", "version", m.Version, "name", m.Name, "direction", direction, "step", done)
+	}
+
+	for i := done; i < len(statements); i++ {
+		if err := r.run(statements[i]); err != nil {
+			return err
+		}
+		err := r.exec(`INSERT INTO schema_progress (version, direction, step) VALUES ($1, $2, $3)
+			ON CONFLICT (version) DO UPDATE SET direction = excluded.direction, step = excluded.step;`,
+			m.Version, direction, i+1)
+		if err != nil {
+			return err
+		}
+		if err := l.heartbeat(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies every migration that hasn't been applied yet, oldest first
+func (r *Runner) Up() error {
+	return r.UpTo(-1)
+}
+
+// Applies every migration up to and including the target version that hasn't been applied yet.
+// A negative target applies all of them.
+func (r *Runner) UpTo(target int) error {
+	if err := r.ensureTables(); err != nil {
+		return err
+	}
+	l, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	// Only read what's applied once the lock is held, so migrations another process just applied are seen
+	versions, err := r.applied()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range r.Migrations {
+		if versions[m.Version] || (target >= 0 && m.Version > target) {
+			continue
+		}
+		if err := r.step(m, "up", m.Up, l); err != nil {
+			return fmt.Errorf("applying %d %s: %w", m.Version, m.Name, err)
+		}
+
+		// Recorded as applied before its progress is forgotten, so a crash in between can't run it again
+		err = r.exec("INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3);",
+			m.Version, m.Name, now())
+		if err != nil {
+			return err
+		}
+		if err := r.exec("DELETE FROM schema_progress WHERE version = $1;", m.Version); err != nil {
+			return err
+		}
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+	return r.refresh("schema_version")
+}
+
+// Reverts every applied migration newer than the target version, newest first.
+// Down(0) reverts all of them. Stops at a migration that can't be reverted.
+func (r *Runner) Down(target int) error {
+	if err := r.ensureTables(); err != nil {
+		return err
+	}
+	l, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	versions, err := r.applied()
+	if err != nil {
+		return err
+	}
+
+	for i := len(r.Migrations) - 1; i >= 0; i-- {
+		m := r.Migrations[i]
+		if !versions[m.Version] || m.Version <= target {
+			continue
+		}
+		if len(m.Down) == 0 {
+			return fmt.Errorf("reverting %d %s: %w", m.Version, m.Name, errIrreversible)
+		}
+		if err := r.step(m, "down", m.Down, l); err != nil {
+			return fmt.Errorf("reverting %d %s: %w", m.Version, m.Name, err)
+		}
+		if err := r.exec("DELETE FROM schema_version WHERE version = $1;", m.Version); err != nil {
+			return err
+		}
+		if err := r.exec("DELETE FROM schema_progress WHERE version = $1;", m.Version); err != nil {
+			return err
+		}
+		slog.Info("Reverted migration", "version", m.Version, "name", m.Name)
+	}
+	return r.refresh("schema_version")
+}
+
+// Runs a migrate command from the command line. The commands are:
+//
+//	up [version]	apply every pending migration, or only those up to version
+//	down <version>	revert every migration newer than version
+//	version			print the current schema version
+func Command(r *Runner, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up [version] | down <version> | version")
+	}
+
+	target := -1
+	if len(args) > 1 {
+		var err error
+		target, err = strconv.Atoi(args[1])
+		if err != nil || target < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		return r.UpTo(target)
+	case "down":
+		if target < 0 {
+			return fmt.Errorf("usage: migrate down <version>")
+		}
+		return r.Down(target)
+	case "version":
+		version, err := r.Version()
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
@@ -0,0 +1,410 @@
+package migrate
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A database/sql driver that records the statements it runs and keeps the runner's own tables in memory.
+// Statements containing FAIL return an error until the database is fixed.
+type fakeDB struct {
+	mu       sync.Mutex
+	versions map[int64]bool
+	progress map[int64][2]driver.Value // direction and step
+	lock     []driver.Value            // owner and heartbeat, or nil when nobody holds it
+	fixed    bool
+	log      []string
+}
+
+var (
+	fakes   = map[string]*fakeDB{}
+	fakesMu sync.Mutex
+)
+
+type fakeDriver struct{}
+
+func init() {
+	sql.Register("migratefake", fakeDriver{})
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakesMu.Lock()
+	defer fakesMu.Unlock()
+	return &fakeConn{fakes[name]}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.Contains(s.query, "FAIL") && !s.db.fixed:
+		return nil, errors.New("statement failed")
+	case strings.HasPrefix(s.query, "INSERT INTO schema_version"):
+		s.db.versions[args[0].(int64)] = true
+	case strings.HasPrefix(s.query, "DELETE FROM schema_version"):
+		delete(s.db.versions, args[0].(int64))
+	case strings.HasPrefix(s.query, "INSERT INTO schema_progress"):
+		s.db.progress[args[0].(int64)] = [2]driver.Value{args[1], args[2]}
+	case strings.HasPrefix(s.query, "DELETE FROM schema_progress"):
+		delete(s.db.progress, args[0].(int64))
+	case strings.HasPrefix(s.query, "INSERT INTO schema_lock"):
+		if s.db.lock != nil {
+			return nil, errors.New("duplicate key")
+		}
+		s.db.lock = []driver.Value{args[0], args[1]}
+	case strings.HasPrefix(s.query, "UPDATE schema_lock"):
+		if s.db.lock == nil || s.db.lock[0] != args[1] {
+			return driver.RowsAffected(0), nil
+		}
+		s.db.lock[1] = args[0]
+	case strings.HasPrefix(s.query, "DELETE FROM schema_lock"):
+		if s.db.lock != nil && s.db.lock[0] == args[0] {
+			s.db.lock = nil
+		}
+	case strings.Contains(s.query, "schema_"):
+	default:
+		s.db.log = append(s.db.log, s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.Contains(s.query, "FROM schema_progress"):
+		rows := &fakeRows{columns: []string{"direction", "step"}}
+		if progress, ok := s.db.progress[args[0].(int64)]; ok {
+			rows.rows = append(rows.rows, progress[:])
+		}
+		return rows, nil
+	case strings.Contains(s.query, "FROM schema_lock"):
+		rows := &fakeRows{columns: []string{"owner", "heartbeat"}}
+		if s.db.lock != nil {
+			rows.rows = append(rows.rows, append([]driver.Value(nil), s.db.lock...))
+		}
+		return rows, nil
+	}
+	rows := &fakeRows{columns: []string{"version"}}
+	for version := range s.db.versions {
+		rows.rows = append(rows.rows, []driver.Value{version})
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// Opens a new empty fake database
+func openFake(t *testing.T) (*sql.DB, *fakeDB) {
+	fake := &fakeDB{versions: map[int64]bool{}, progress: map[int64][2]driver.Value{}}
+	fakesMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(fakes))
+	fakes[name] = fake
+	fakesMu.Unlock()
+
+	db, err := sql.Open("migratefake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+// Returns the statements run since the last call
+func (f *fakeDB) take() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	log := f.log
+	f.log = nil
+	return log
+}
+
+func (f *fakeDB) applied() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	versions := []int{}
+	for version := range f.versions {
+		versions = append(versions, int(version))
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Migrations given out of order, so the runner has to sort them
+var testMigrations = []Migration{
+	{Version: 3, Name: "three", Up: []string{"up 3"}, Down: []string{"down 3"}},
+	{Version: 1, Name: "one", Up: []string{"up 1a", "up 1b"}, Down: []string{"down 1"}},
+	{Version: 2, Name: "two", Up: []string{"up 2", "REFRESH TABLE two;"}, Down: []string{"down 2"}},
+}
+
+func TestRunner(t *testing.T) {
+	tests := []struct {
+		name    string
+		refresh bool
+		steps   []func(r *Runner) error
+		want    []string
+		applied []int
+	}{
+		{
+			name:    "up applies every migration in version order",
+			steps:   []func(r *Runner) error{(*Runner).Up},
+			want:    []string{"up 1a", "up 1b", "up 2", "up 3"},
+			applied: []int{1, 2, 3},
+		},
+		{
+			name:    "up runs REFRESH TABLE when the database needs it",
+			refresh: true,
+			steps:   []func(r *Runner) error{(*Runner).Up},
+			want:    []string{"up 1a", "up 1b", "up 2", "REFRESH TABLE two;", "up 3"},
+			applied: []int{1, 2, 3},
+		},
+		{
+			name:    "running up again applies nothing",
+			steps:   []func(r *Runner) error{(*Runner).Up, (*Runner).Up},
+			want:    []string{"up 1a", "up 1b", "up 2", "up 3"},
+			applied: []int{1, 2, 3},
+		},
+		{
+			name: "up to a version stops there and a later up continues",
+			steps: []func(r *Runner) error{
+				func(r *Runner) error { return r.UpTo(1) },
+				(*Runner).Up,
+			},
+			want:    []string{"up 1a", "up 1b", "up 2", "up 3"},
+			applied: []int{1, 2, 3},
+		},
+		{
+			name: "down reverts newest first",
+			steps: []func(r *Runner) error{
+				(*Runner).Up,
+				func(r *Runner) error { return r.Down(1) },
+			},
+			want:    []string{"up 1a", "up 1b", "up 2", "up 3", "down 3", "down 2"},
+			applied: []int{1},
+		},
+		{
+			name: "down to 0 reverts everything and up applies it again",
+			steps: []func(r *Runner) error{
+				(*Runner).Up,
+				func(r *Runner) error { return r.Down(0) },
+				(*Runner).Up,
+			},
+			want: []string{
+				"up 1a", "up 1b", "up 2", "up 3",
+				"down 3", "down 2", "down 1",
+				"up 1a", "up 1b", "up 2", "up 3",
+			},
+			applied: []int{1, 2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := openFake(t)
+			r := NewRunner(db, testMigrations, tt.refresh)
+			for _, step := range tt.steps {
+				if err := step(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := fake.take(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ran %q, want %q", got, tt.want)
+			}
+			if got := fake.applied(); !reflect.DeepEqual(got, tt.applied) {
+				t.Errorf("applied versions %v, want %v", got, tt.applied)
+			}
+		})
+	}
+}
+
+func TestRunnerStopsAtFailedMigration(t *testing.T) {
+	db, fake := openFake(t)
+	migrations := []Migration{
+		{Version: 1, Name: "one", Up: []string{"up 1"}},
+		{Version: 2, Name: "two", Up: []string{"up 2a", "FAIL up 2b", "up 2c"}},
+		{Version: 3, Name: "three", Up: []string{"up 3"}},
+	}
+	r := NewRunner(db, migrations, false)
+
+	if err := r.Up(); err == nil {
+		t.Fatal("Up succeeded, want an error")
+	}
+	if got, want := fake.take(), []string{"up 1", "up 2a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	if version, err := r.Version(); err != nil || version != 1 {
+		t.Errorf("Version() = %d, %v; want 1", version, err)
+	}
+	if fake.lock != nil {
+		t.Errorf("lock still held by %v after the failure", fake.lock[0])
+	}
+
+	// The next run carries on with the statement that failed, without running the ones before it again
+	fake.fixed = true
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fake.take(), []string{"FAIL up 2b", "up 2c", "up 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	if got, want := fake.applied(), []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied versions %v, want %v", got, want)
+	}
+	if len(fake.progress) != 0 {
+		t.Errorf("progress left behind: %v", fake.progress)
+	}
+}
+
+func TestDownStopsAtIrreversibleMigration(t *testing.T) {
+	db, fake := openFake(t)
+	migrations := []Migration{
+		{Version: 1, Name: "one", Up: []string{"up 1"}, Down: []string{"down 1"}},
+		{Version: 2, Name: "two", Up: []string{"up 2"}},
+		{Version: 3, Name: "three", Up: []string{"up 3"}, Down: []string{"down 3"}},
+	}
+	r := NewRunner(db, migrations, false)
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	fake.take()
+
+	if err := r.Down(0); !errors.Is(err, errIrreversible) {
+		t.Errorf("Down(0) returned %v, want %v", err, errIrreversible)
+	}
+	if got, want := fake.take(), []string{"down 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+	if got, want := fake.applied(), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied versions %v, want %v", got, want)
+	}
+}
+
+func TestRunnerWaitsForLock(t *testing.T) {
+	db, fake := openFake(t)
+	fake.lock = []driver.Value{"other", now()}
+	go func() {
+		time.Sleep(lockPollInterval / 2)
+		fake.mu.Lock()
+		fake.lock = nil
+		fake.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := NewRunner(db, testMigrations, false).Up(); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < lockPollInterval/2 {
+		t.Errorf("applied the migrations after %v, before the lock was released", waited)
+	}
+	if got, want := fake.applied(), []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied versions %v, want %v", got, want)
+	}
+}
+
+func TestRunnerTakesOverAbandonedLock(t *testing.T) {
+	db, fake := openFake(t)
+	fake.lock = []driver.Value{"other", now() - int64(2*lockTimeout/time.Millisecond)}
+
+	start := time.Now()
+	if err := NewRunner(db, testMigrations, false).Up(); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited >= lockPollInterval {
+		t.Errorf("waited %v for an abandoned lock", waited)
+	}
+	if got, want := fake.applied(), []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied versions %v, want %v", got, want)
+	}
+	if fake.lock != nil {
+		t.Errorf("lock still held by %v", fake.lock[0])
+	}
+}
+
+func TestConvertTable(t *testing.T) {
+	columns := []Column{{Name: "user_id", Type: "TEXT"}, {Name: "funds", Type: "BIGINT", From: "funds * 100"}}
+	want := []string{
+		"CREATE TABLE IF NOT EXISTS users_converted(user_id TEXT, funds BIGINT, PRIMARY KEY (user_id));",
+		"REFRESH TABLE users;",
+		"INSERT INTO users_converted (user_id, funds) (SELECT user_id, funds * 100 FROM users) ON CONFLICT DO NOTHING;",
+		"REFRESH TABLE users_converted;",
+		"DROP TABLE IF EXISTS users;",
+		"CREATE TABLE IF NOT EXISTS users(user_id TEXT, funds BIGINT, PRIMARY KEY (user_id));",
+		"INSERT INTO users (user_id, funds) (SELECT user_id, funds FROM users_converted) ON CONFLICT DO NOTHING;",
+		"REFRESH TABLE users;",
+		"DROP TABLE IF EXISTS users_converted;",
+	}
+	if got := ConvertTable("users", columns, "user_id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConvertTable() = %q, want %q", got, want)
+	}
+
+	// Without a primary key there's nothing to detect copied rows by
+	for _, statement := range ConvertTable("events", columns, "") {
+		if strings.Contains(statement, "PRIMARY KEY") || strings.Contains(statement, "ON CONFLICT") {
+			t.Errorf("ConvertTable() without a primary key returned %q", statement)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+		applied []int
+	}{
+		{[]string{"up"}, false, []int{1, 2, 3}},
+		{[]string{"up", "2"}, false, []int{1, 2}},
+		{[]string{"version"}, false, []int{}},
+		{[]string{}, true, []int{}},
+		{[]string{"down"}, true, []int{}},
+		{[]string{"up", "-1"}, true, []int{}},
+		{[]string{"up", "two"}, true, []int{}},
+		{[]string{"sideways"}, true, []int{}},
+	}
+	for _, tt := range tests {
+		db, fake := openFake(t)
+		err := Command(NewRunner(db, testMigrations, false), tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Command(%q) returned %v, want error %v", tt.args, err, tt.wantErr)
+		}
+		if got := fake.applied(); !reflect.DeepEqual(got, tt.applied) {
+			t.Errorf("Command(%q) applied %v, want %v", tt.args, got, tt.applied)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package money provides an exact fixed-point currency type shared by all of the day trading services.
+//
+// Amounts are stored as a whole number of cents, so adding, subtracting and multiplying by a number of
+// shares never loses precision the way float64 does. Money marshals to JSON as a plain number (12.34),
+// to XML as text ("12.34"), and to SQL as an integer number of cents.
+package money
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// An amount of money in cents
+type Money int64
+
+// The largest amount Parse and FromFloat accept, in dollars
+const maxDollars = math.MaxInt64 / 100
+
+// Returns the given number of cents as Money
+func FromCents(cents int64) Money {
+	return Money(cents)
+}
+
+// Converts a dollar amount to Money, rounding to the nearest cent
+func FromFloat(dollars float64) Money {
+	return Money(math.Round(dollars * 100))
+}
+
+// Parses a decimal dollar amount such as "12", "12.3", "-0.05" or "1e2".
+// Amounts with more than two decimal places are rounded to the nearest cent, half away from zero.
+func Parse(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("money: can't parse empty amount")
+	}
+
+	// Exponents are rare (only from clients formatting floats), so let strconv expand them
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) || math.Abs(f) > maxDollars {
+			return 0, fmt.Errorf("money: invalid amount %q", s)
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole == "" && frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("money: invalid amount %q", s)
+	}
+
+	var dollars int64
+	if whole != "" {
+		var err error
+		dollars, err = strconv.ParseInt(whole, 10, 64)
+		if err != nil || dollars >= maxDollars {
+			return 0, fmt.Errorf("money: amount %q out of range", s)
+		}
+	}
+
+	// Keep two decimal places and round using the third
+	padded := frac + "000"
+	cents, _ := strconv.ParseInt(padded[:2], 10, 64)
+	total := dollars*100 + cents
+	if padded[2] >= '5' {
+		total++
+	}
+
+	if negative {
+		total = -total
+	}
+	return Money(total), nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the amount as a whole number of cents
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+// Returns the amount in dollars. Only use this for display or for APIs that need a float.
+func (m Money) Float64() float64 {
+	return float64(m) / 100
+}
+
+// Formats the amount in dollars with exactly two decimal places, e.g. "12.30" or "-0.05"
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Returns the amount multiplied by a number of shares
+func (m Money) Mul(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// Returns the number of whole shares at the given price that the amount can pay for
+func (m Money) Shares(price Money) int {
+	if price <= 0 || m <= 0 {
+		return 0
+	}
+	return int(m / price)
+}
+
+// Marshals the amount as a JSON number in dollars, e.g. 12.3
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Accepts a JSON number or a string holding one. null leaves the amount unchanged.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if len(s) > 0 && s[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Used for XML elements and attributes
+func (m Money) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalText(b []byte) error {
+	parsed, err := Parse(string(b))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Stores the amount in the database as an integer number of cents
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
+
+// Reads an integer number of cents from the database
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*m = Money(v)
+	case float64:
+		// Some drivers return every number as a float
+		*m = Money(math.Round(v))
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case nil:
+		*m = 0
+	default:
+		return fmt.Errorf("money: can't scan %T", src)
+	}
+	return nil
+}
+
+func (m *Money) scanString(s string) error {
+	cents, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("money: can't scan %q as cents", s)
+	}
+	*m = Money(cents)
+	return nil
+}
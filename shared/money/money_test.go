@@ -0,0 +1,120 @@
+package money
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"12", 1200},
+		{"12.3", 1230},
+		{"12.34", 1234},
+		{" 12.34 ", 1234},
+		{"0.05", 5},
+		{".5", 50},
+		{"5.", 500},
+		{"-0.05", -5},
+		{"+1.50", 150},
+		{"1.005", 101},
+		{"1.004", 100},
+		{"-1.005", -101},
+		{"1e2", 10000},
+		{"1.5E1", 1500},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q) returned error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{"", " ", ".", "-", "abc", "1.2.3", "1,000", "$5", "1e400", "NaN", "99999999999999999999"} {
+		if got, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{1230, "12.30"},
+		{-5, "-0.05"},
+		{-1234, "-12.34"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Money
+	}{
+		{int64(1234), 1234},
+		{float64(1234), 1234},
+		{float64(1233.6), 1234},
+		{[]byte("1234"), 1234},
+		{"-5", -5},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		m := Money(99)
+		if err := m.Scan(tt.src); err != nil {
+			t.Errorf("Scan(%#v) returned error %v", tt.src, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("Scan(%#v) = %d, want %d", tt.src, m, tt.want)
+		}
+	}
+}
+
+func TestScanInvalid(t *testing.T) {
+	for _, src := range []interface{}{"12.34", []byte("abc"), true} {
+		var m Money
+		if err := m.Scan(src); err == nil {
+			t.Errorf("Scan(%#v) = %d, want an error", src, m)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{`12.34`, 1234},
+		{`"12.34"`, 1234},
+		{`7`, 700},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := m.UnmarshalJSON([]byte(tt.in)); err != nil {
+			t.Errorf("UnmarshalJSON(%s) returned error %v", tt.in, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, want %d", tt.in, m, tt.want)
+		}
+	}
+
+	m := Money(1234)
+	if err := m.UnmarshalJSON([]byte("null")); err != nil || m != 1234 {
+		t.Errorf("UnmarshalJSON(null) = %d, %v; want the amount unchanged", m, err)
+	}
+}
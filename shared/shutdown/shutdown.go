@@ -0,0 +1,71 @@
+// Package shutdown runs an HTTP server until the process is asked to stop, then drains it.
+//
+// On SIGINT or SIGTERM the server stops accepting connections and waits for the requests it's already
+// handling to finish. The service's own drain steps (stopping background work, flushing queues) then run
+// in order, sharing whatever is left of the shutdown timeout.
+package shutdown
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Runs the server until the process receives SIGINT or SIGTERM, then shuts it down gracefully
+// Parameters:
+// 		srv: 		the server to run
+// 		timeout:	how long to wait for running requests and drain steps before giving up on them
+// 		drain:		steps to run once the server has stopped handling requests, in order
+//
+// Returns the error the server failed to start with, or the error from shutting it down
+func ListenAndServe(srv *http.Server, timeout time.Duration, drain ...func(ctx context.Context)) error {
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Gave up waiting for running requests", "error", err)
+	}
+	for _, step := range drain {
+		step(ctx)
+	}
+	return err
+}
+
+// Waits for the group to finish, or for the context to be done
+// Returns false if it gave up waiting
+func Wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
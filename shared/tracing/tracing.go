@@ -0,0 +1,178 @@
+// Package tracing follows a command across the web, transaction and audit servers with OpenTelemetry.
+//
+// Each server wraps its handler in Middleware, which continues the trace from the W3C traceparent
+// header or starts a new one, and records a span for the request. Requests to the other servers are
+// sent with Client so the trace carries on through them.
+//
+// Middleware also reads the UserID and TransactionNum from a command's JSON body, once, and adds them to
+// the request's context, where CommandFrom finds them. Code that works on a command is passed the
+// request's context, and starts its spans from it.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/config"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The exporters Start accepts
+var Exporters = []string{"none", "otlp", "file"}
+
+// Checks the trace_exporter and trace_target settings, filling in the exporter's default target if there isn't one
+func CheckSettings(exporter string, target *string) error {
+	if err := config.CheckOneOf("trace_exporter", exporter, Exporters...); err != nil {
+		return err
+	}
+	switch {
+	case exporter == "otlp" && *target == "":
+		*target = "localhost:4318"
+	case exporter == "file" && *target == "":
+		*target = "traces.json"
+	case exporter == "otlp":
+		return config.CheckHostPort("trace_target", *target)
+	}
+	return nil
+}
+
+// Sends requests with the trace of their context in the headers, and a span for each
+var Transport = otelhttp.NewTransport(http.DefaultTransport)
+
+// Sends requests to the other servers with the current trace in their headers
+var Client = &http.Client{Transport: Transport}
+
+// Starts exporting the service's spans
+// Parameters:
+// 		service: 	the name the service's spans are reported under
+// 		exporter:	where spans are sent, one of Exporters. "none" records nothing.
+// 		target:		the OTLP/HTTP collector's host:port for "otlp", or the file to write to for "file"
+//
+// Returns a function that flushes any spans that haven't been exported yet and stops exporting
+func Start(service string, exporter string, target string) (func(ctx context.Context), error) {
+	// Headers are passed on even when this service records nothing, so the trace isn't broken
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	switch exporter {
+	case "none":
+		return func(ctx context.Context) {}, nil
+	case "otlp":
+		var err error
+		exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpoint(target), otlptracehttp.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+	case "file":
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) {
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("Failed to flush trace spans", "error", err)
+		}
+	}, nil
+}
+
+// Starts a span as a child of the span in ctx. End the returned span once the work is done.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer("github.com/LeeZeitz/DayTradingSystem").Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Starts a span for work done on behalf of several traces at once, such as sending a batch of their events.
+// It's a child of the span in ctx, and linked to each of the spans given.
+func StartLinkedSpan(ctx context.Context, name string, linked []trace.SpanContext, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	links := []trace.Link{}
+	for _, sc := range linked {
+		if sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return otel.Tracer("github.com/LeeZeitz/DayTradingSystem").Start(ctx, name, trace.WithAttributes(attrs...), trace.WithLinks(links...))
+}
+
+// Wraps a server's handler so every request gets a span, continuing the trace the caller sent.
+// Health checks, metric scrapes and admin requests aren't traced.
+func Middleware(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(bindCommand(h), "request",
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/healthz", "/readyz", "/metrics", "/admin/log_level":
+				return false
+			}
+			return true
+		}),
+	)
+}
+
+// The user and transaction a command request is for
+type Command struct {
+	UserID         string
+	TransactionNum int
+}
+
+type commandKey struct{}
+
+// Reads the UserID and TransactionNum from the request's body, tags its span with the TransactionNum, and
+// adds both to its context. The body is put back for the handler to read.
+func bindCommand(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		cmd := Command{"", 0}
+		if err != nil || json.Unmarshal(body, &cmd) != nil || (cmd.UserID == "" && cmd.TransactionNum == 0) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), commandKey{}, cmd)
+		if cmd.TransactionNum != 0 {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Int("transaction_num", cmd.TransactionNum))
+			// Work done for the command isn't cancelled if its client hangs up
+			ctx = context.WithoutCancel(ctx)
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the UserID and TransactionNum of the command whose request the context is from. Both are empty
+// if the request didn't name them, or the context isn't a request's.
+func CommandFrom(ctx context.Context) Command {
+	cmd, _ := ctx.Value(commandKey{}).(Command)
+	return cmd
+}
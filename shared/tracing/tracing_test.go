@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareAddsCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		want      Command
+		cancelled bool // whether the handler's context ends when the client hangs up
+	}{
+		{"command", `{"UserID": "alice", "TransactionNum": 7, "Amount": 10}`, Command{"alice", 7}, false},
+		{"user without a transaction", `{"UserID": "alice"}`, Command{"alice", 0}, true},
+		{"not a command", `{"Filename": "log.xml"}`, Command{}, true},
+		{"not json", `hello`, Command{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Command
+			var body string
+			var ctx context.Context
+			h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = CommandFrom(r.Context())
+				b, _ := ioutil.ReadAll(r.Body)
+				body = string(b)
+				ctx = r.Context()
+			}))
+
+			client, hangUp := context.WithCancel(context.Background())
+			r := httptest.NewRequest(http.MethodPost, "/add", strings.NewReader(tt.body)).WithContext(client)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			hangUp()
+
+			if got != tt.want {
+				t.Errorf("CommandFrom() = %+v, want %+v", got, tt.want)
+			}
+			if body != tt.body {
+				t.Errorf("handler read body %q, want %q", body, tt.body)
+			}
+			if cancelled := ctx.Err() != nil; cancelled != tt.cancelled {
+				t.Errorf("context cancelled = %v after the client hung up, want %v", cancelled, tt.cancelled)
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/shutdown"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Audit events are queued in memory and sent to the audit server's /logBatch in batches by background
+// workers, so commands don't wait on the audit server. A batch that fails is retried with backoff until
+// the audit server stores it.
+//
+// An event is never dropped because the audit server is slow or down. If the queue stays full for longer
+// than audit_enqueue_timeout, the event is appended to the spool file instead, and so is anything still
+// unsent when the server stops. The spool is sent again once the queue has room, and on the next start.
+// An event can be stored twice if the server stops while its batch is in flight, but not lost.
+
+const (
+	// Waits between attempts to send a batch double from the first to the last
+	auditRetryMin = 100 * time.Millisecond
+	auditRetryMax = 5 * time.Second
+
+	// How often the spool is checked for events to send again
+	auditSpoolInterval = 30 * time.Second
+
+	// The longest DUMPLOG waits for the events logged before it to be sent
+	auditFlushTimeout = 10 * time.Second
+)
+
+// The audit server couldn't parse an event. Sending it again won't help.
+var errAuditEventRejected = errors.New("audit server rejected the event")
+
+// An event waiting to be sent to the audit server
+type auditEvent struct {
+	Type           string          // which log the event goes in, e.g. "userCommand"
+	TransactionNum int             // the command it was logged for
+	Event          json.RawMessage // the body the log's single-event endpoint takes
+
+	trace      trace.SpanContext // the span of the command it was logged for, linked from the batch's span
+	generation int               // the flush generation it was queued in
+}
+
+// Returns a logger for lines about the event, in the trace of the command it was logged for
+func (e auditEvent) logger() *slog.Logger {
+	return logging.ForCommand(trace.ContextWithSpanContext(context.Background(), e.trace), "", e.TransactionNum, "")
+}
+
+type auditClient struct {
+	url            string
+	queue          chan auditEvent
+	workers        int
+	batchSize      int
+	batchInterval  time.Duration
+	enqueueTimeout time.Duration
+	spool          *auditSpool
+
+	// Held for reading while an event is queued, and for writing to stop queueing
+	queueing sync.RWMutex
+	stopped  bool
+
+	// Events that have been queued but not yet stored or spooled, by flush generation
+	outstanding struct {
+		sync.Mutex
+		generation int
+		events     map[int]int
+		total      int
+	}
+
+	stopping chan struct{} // closed when the workers should send what's left and exit
+	abort    chan struct{} // closed when the workers should stop sending and spool what's left
+	running  sync.WaitGroup
+}
+
+// Creates a client that sends audit events to the audit server. Call start before events are logged.
+// Parameters:
+// 		url: 				base URL of the audit server
+// 		queueSize:			how many events can wait to be sent
+// 		workers:			how many batches can be sent at once
+// 		batchSize:			the most events sent in one request
+// 		batchInterval:		the longest a partial batch waits for more events before it's sent
+// 		enqueueTimeout:		how long logging an event waits for room in the queue before spooling it
+// 		spoolPath:			the file events are spooled to
+//
+func newAuditClient(url string, queueSize int, workers int, batchSize int, batchInterval time.Duration, enqueueTimeout time.Duration, spoolPath string) *auditClient {
+	c := &auditClient{
+		url:            url,
+		queue:          make(chan auditEvent, queueSize),
+		workers:        workers,
+		batchSize:      batchSize,
+		batchInterval:  batchInterval,
+		enqueueTimeout: enqueueTimeout,
+		spool:          &auditSpool{path: spoolPath},
+		stopping:       make(chan struct{}),
+		abort:          make(chan struct{}),
+	}
+	c.outstanding.events = map[int]int{}
+	return c
+}
+
+// Starts the workers, and sends whatever was spooled when the server last stopped
+func (c *auditClient) start() {
+	for i := 0; i < c.workers; i++ {
+		c.running.Add(1)
+		go c.work()
+	}
+	c.running.Add(1)
+	go c.resend()
+}
+
+// Queues an event to be sent to the audit server
+// Parameters:
+// 		ctx: 			the context of the command it was logged for
+// 		eventType: 		which log the event goes in, one of the types /logBatch takes
+// 		transactionNum:	the command it was logged for
+// 		event:			the event, as the log's single-event endpoint takes it
+//
+func (c *auditClient) send(ctx context.Context, eventType string, transactionNum int, event interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logging.ForCommand(ctx, "", transactionNum, "").Error("Failed to encode audit event", "type", eventType, "error", err)
+		return
+	}
+	c.enqueue(auditEvent{
+		Type:           eventType,
+		TransactionNum: transactionNum,
+		Event:          body,
+		trace:          trace.SpanContextFromContext(ctx),
+	})
+}
+
+// Adds the event to the queue, or spools it if the queue stays full or the client has stopped
+func (c *auditClient) enqueue(e auditEvent) {
+	c.outstanding.Lock()
+	e.generation = c.outstanding.generation
+	c.outstanding.events[e.generation]++
+	c.outstanding.total++
+	c.outstanding.Unlock()
+
+	c.queueing.RLock()
+	defer c.queueing.RUnlock()
+	if c.stopped {
+		c.spill(e)
+		return
+	}
+
+	select {
+	case c.queue <- e:
+		return
+	default:
+	}
+	timer := time.NewTimer(c.enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case c.queue <- e:
+	case <-timer.C:
+		c.spill(e)
+	}
+}
+
+// Marks the events as stored or spooled, so flush stops waiting for them
+func (c *auditClient) finish(events []auditEvent) {
+	c.outstanding.Lock()
+	defer c.outstanding.Unlock()
+	for _, e := range events {
+		c.outstanding.events[e.generation]--
+		if c.outstanding.events[e.generation] == 0 {
+			delete(c.outstanding.events, e.generation)
+		}
+		c.outstanding.total--
+	}
+}
+
+// Returns how many events have been queued but not yet stored or spooled
+func (c *auditClient) pending() int {
+	c.outstanding.Lock()
+	defer c.outstanding.Unlock()
+	return c.outstanding.total
+}
+
+// Waits until every event queued before the call has been stored or spooled, or the context is done.
+// Events queued while it waits aren't waited for.
+// Returns false if it gave up waiting
+func (c *auditClient) flush(ctx context.Context) bool {
+	c.outstanding.Lock()
+	generation := c.outstanding.generation
+	c.outstanding.generation++
+	c.outstanding.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c.outstanding.Lock()
+		waiting := false
+		for g := range c.outstanding.events {
+			if g <= generation {
+				waiting = true
+				break
+			}
+		}
+		c.outstanding.Unlock()
+		if !waiting {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Stops queueing events and sends the ones that are queued. Whatever hasn't been sent when the
+// context is done is spooled for the next start.
+func (c *auditClient) stop(ctx context.Context) {
+	c.queueing.Lock()
+	c.stopped = true
+	c.queueing.Unlock()
+	close(c.stopping)
+
+	if !shutdown.Wait(ctx, &c.running) {
+		close(c.abort)
+		c.running.Wait()
+		slog.Warn("Gave up waiting for audit events to be sent, spooled the rest", "spool", c.spool.path)
+	}
+	// Nothing can be queued once stopped is set, so this only catches what an aborted worker didn't take
+	for {
+		select {
+		case e := <-c.queue:
+			c.spill(e)
+			continue
+		default:
+		}
+		break
+	}
+}
+
+// Collects queued events into batches and sends them until the client stops
+func (c *auditClient) work() {
+	defer c.running.Done()
+
+	ticker := time.NewTicker(c.batchInterval)
+	defer ticker.Stop()
+	batch := make([]auditEvent, 0, c.batchSize)
+	for {
+		select {
+		case e := <-c.queue:
+			batch = append(batch, e)
+			if len(batch) < c.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-c.stopping:
+			// Send everything that's left before exiting
+			for {
+				select {
+				case e := <-c.queue:
+					batch = append(batch, e)
+					if len(batch) == c.batchSize {
+						c.deliver(batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			if len(batch) > 0 {
+				c.deliver(batch)
+			}
+			return
+		}
+		c.deliver(batch)
+		batch = batch[:0]
+	}
+}
+
+// Sends the batch until the audit server has stored all of it, waiting longer after each failure.
+// Spools what's left if the client is aborted.
+func (c *auditClient) deliver(batch []auditEvent) {
+	wait := auditRetryMin
+	for len(batch) > 0 {
+		select {
+		case <-c.abort:
+			c.spill(batch...)
+			return
+		default:
+		}
+
+		stored, err := c.post(batch)
+		c.finish(batch[:stored])
+		batch = batch[stored:]
+		if err == nil {
+			return
+		}
+
+		if errors.Is(err, errAuditEventRejected) {
+			// Logged in full so it can be stored by hand, since sending it again would fail the same way
+			e := batch[0]
+			auditEventsRejected.Inc()
+			e.logger().Error("Audit server rejected event", "type", e.Type, "event", string(e.Event), "error", err)
+			c.finish(batch[:1])
+			batch = batch[1:]
+			continue
+		}
+
+		auditPostFailures.WithLabelValues("/logBatch").Add(float64(len(batch)))
+		slog.Warn("Failed to send audit events, retrying", "events", len(batch), "retry_in", wait.String(), "error", err)
+		select {
+		case <-time.After(wait):
+		case <-c.abort:
+			c.spill(batch...)
+			return
+		}
+		auditPostRetries.WithLabelValues("/logBatch").Add(float64(len(batch)))
+		wait *= 2
+		if wait > auditRetryMax {
+			wait = auditRetryMax
+		}
+	}
+}
+
+// Sends the batch to the audit server in one request
+// Returns how many of the events, from the start of the batch, the audit server stored
+func (c *auditClient) post(batch []auditEvent) (int, error) {
+	links := make([]trace.SpanContext, len(batch))
+	for i, e := range batch {
+		links[i] = e.trace
+	}
+	// Aborting cancels a batch that's in flight, so stopping doesn't wait on a hung audit server
+	sending, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.abort:
+			cancel()
+		case <-sending.Done():
+		}
+	}()
+	ctx, span := tracing.StartLinkedSpan(sending, "audit batch", links, attribute.Int("events", len(batch)))
+	defer span.End()
+
+	stored, err := c.postBatch(ctx, batch)
+	span.SetAttributes(attribute.Int("stored", stored))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return stored, err
+}
+
+func (c *auditClient) postBatch(ctx context.Context, batch []auditEvent) (int, error) {
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(batch)
+	req, err := http.NewRequest(http.MethodPost, c.url+"/logBatch", b)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	res, err := tracing.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	result := struct {
+		Stored int
+		Error  string
+	}{0, ""}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("%s: %s", res.Status, err)
+	}
+	if result.Stored < 0 || result.Stored > len(batch) {
+		return 0, fmt.Errorf("audit server stored %d of %d events", result.Stored, len(batch))
+	}
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return result.Stored, nil
+	case res.StatusCode == http.StatusBadRequest && result.Stored < len(batch):
+		return result.Stored, fmt.Errorf("%w: %s", errAuditEventRejected, result.Error)
+	default:
+		return result.Stored, fmt.Errorf("%s: %s", res.Status, result.Error)
+	}
+}
+
+// Writes the events to the spool so they're sent later
+func (c *auditClient) spill(events ...auditEvent) {
+	if err := c.spool.write(events); err != nil {
+		// The log is the only place left to keep them
+		for _, e := range events {
+			e.logger().Error("Failed to spool audit event", "type", e.Type, "event", string(e.Event), "error", err)
+		}
+	} else {
+		auditEventsSpooled.Add(float64(len(events)))
+	}
+	c.finish(events)
+}
+
+// Sends whatever is in the spool again, on start and then whenever the queue has room, until the client stops
+func (c *auditClient) resend() {
+	defer c.running.Done()
+
+	ticker := time.NewTicker(auditSpoolInterval)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		if first || len(c.queue) < cap(c.queue)/2 {
+			n, err := c.spool.replay(c.enqueue)
+			if err != nil {
+				slog.Error("Failed to read the audit spool", "spool", c.spool.path, "error", err)
+			} else if n > 0 {
+				slog.Info("Resent spooled audit events", "events", n)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.stopping:
+			return
+		}
+	}
+}
+
+// A file of audit events waiting to be sent, one JSON object per line
+type auditSpool struct {
+	sync.Mutex
+	path string
+}
+
+// Appends the events to the spool
+func (s *auditSpool) write(events []auditEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Takes every event out of the spool and passes it to send. Events spooled while it runs are left for next time.
+// Returns how many events were sent
+func (s *auditSpool) replay(send func(auditEvent)) (int, error) {
+	// Events are moved aside first so the spool can be written while they're sent. A replay file that's
+	// already there was left by a server that stopped partway through sending it.
+	replaying := s.path + ".replay"
+	s.Lock()
+	_, err := os.Stat(replaying)
+	if os.IsNotExist(err) {
+		err = os.Rename(s.path, replaying)
+	}
+	s.Unlock()
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(replaying)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sent := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := auditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			slog.Error("Skipped unreadable audit event in the spool", "event", scanner.Text(), "error", err)
+			continue
+		}
+		send(e)
+		sent++
+	}
+	if err := scanner.Err(); err != nil {
+		return sent, err
+	}
+	return sent, os.Remove(replaying)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/go-redis/redis"
+)
+
+const (
+	quoteLockTTL      = quoteFetchTimeout + 5*time.Second // outlasts any fetch, since fetches are cut off at quoteFetchTimeout
+	quoteLockPollRate = 25 * time.Millisecond
+)
+
+var errQuoteLockTimeout = errors.New("timed out waiting for another server to fetch the quote")
+
+// Releases the lock only if it's still held by the given token, so an expired lock that was
+// taken over by another server isn't released by mistake
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// A fetch that is in progress. Goroutines that want the same quote wait on it instead of starting their own.
+type quoteFetch struct {
+	done      chan struct{}
+	price     money.Money
+	timestamp int64
+	err       error
+}
+
+// Coalesces concurrent quote fetches for the same symbol within this server
+type quoteFetchGroup struct {
+	mu      sync.Mutex
+	fetches map[string]*quoteFetch
+}
+
+var quoteFetches = &quoteFetchGroup{fetches: map[string]*quoteFetch{}}
+
+// Runs fetch for the symbol, unless a fetch for it is already in progress, in which case its result is returned
+func (g *quoteFetchGroup) do(symbol string, fetch func() (money.Money, int64, error)) (money.Money, int64, error) {
+	g.mu.Lock()
+	if f, ok := g.fetches[symbol]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.price, f.timestamp, f.err
+	}
+	f := &quoteFetch{done: make(chan struct{})}
+	g.fetches[symbol] = f
+	g.mu.Unlock()
+
+	f.price, f.timestamp, f.err = fetch()
+
+	g.mu.Lock()
+	delete(g.fetches, symbol)
+	g.mu.Unlock()
+	close(f.done)
+
+	return f.price, f.timestamp, f.err
+}
+
+// Fetches a quote that isn't in the cache. Across goroutines, and across transaction servers through
+// a Redis lock, only one fetch per symbol is sent to the quote server at a time.
+// Parameters:
+//		ctx: 			the context of the command that wants the quote. Commands that wait share the first one's fetch
+//		symbol: 		(string) symbol of the stock to quote
+// 		transactionNum:	transaction number to log the quote server hit under
+// 		userID:			id of the user requesting the quote
+//
+func fetchQuoteCoalesced(ctx context.Context, symbol string, transactionNum int, userID string) (money.Money, int64, error) {
+	return quoteFetches.do(symbol, func() (money.Money, int64, error) {
+		return fetchQuoteLocked(ctx, symbol, transactionNum, userID)
+	})
+}
+
+// Takes the symbol's Redis lock and fetches the quote. If another server holds the lock, waits for it
+// to cache the quote instead.
+func fetchQuoteLocked(ctx context.Context, symbol string, transactionNum int, userID string) (money.Money, int64, error) {
+	key := "quote_lock:" + symbol
+	token := newLockToken()
+	deadline := time.Now().Add(quoteLockTTL)
+
+	for time.Now().Before(deadline) {
+		// Another server may have cached the quote while we were waiting
+		price, timestamp, err := getCachedQuote(symbol)
+		if err != redis.Nil {
+			return price, timestamp, err
+		}
+
+		acquired, err := cache.SetNX(key, token, quoteLockTTL).Result()
+		if err != nil {
+			// Without Redis there's nobody to coordinate with, so just fetch
+			failGracefully(err, "Failed to take quote lock")
+			return fetchQuote(ctx, symbol, transactionNum, userID)
+		}
+		if acquired {
+			defer releaseLockScript.Run(cache, []string{key}, token)
+			return fetchQuote(ctx, symbol, transactionNum, userID)
+		}
+
+		time.Sleep(quoteLockPollRate)
+	}
+	return 0, 0, errQuoteLockTimeout
+}
+
+func newLockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/config"
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+)
+
+// Everything about the transaction server that can be configured. See the config package for how it's loaded.
+type transactionConfig struct {
+	Port                int           `config:"port" default:"8080" help:"port to listen on"`
+	Database            string        `config:"database" default:"crate" help:"one of crate, postgres or memory"`
+	DatabaseURL         string        `config:"database_url" help:"address of the crate or postgres database, defaults to its local address"`
+	RedisAddr           string        `config:"redis_addr" default:"localhost:6379" help:"host:port of Redis"`
+	AuditURL            string        `config:"audit_url" default:"http://localhost:8081" help:"base URL of the audit server"`
+	AuditQueueSize      int           `config:"audit_queue_size" default:"10000" help:"how many audit events can wait to be sent"`
+	AuditWorkers        int           `config:"audit_workers" default:"4" help:"how many batches of audit events can be sent at once"`
+	AuditBatchSize      int           `config:"audit_batch_size" default:"100" help:"the most audit events sent in one request"`
+	AuditBatchInterval  time.Duration `config:"audit_batch_interval" default:"100ms" help:"the longest a partial batch of audit events waits before it's sent"`
+	AuditEnqueueTimeout time.Duration `config:"audit_enqueue_timeout" default:"50ms" help:"how long a command waits for room in the audit queue before spooling its event"`
+	AuditSpoolFile      string        `config:"audit_spool_file" default:"audit-spool.jsonl" help:"file audit events are kept in when they can't be queued or sent before stopping"`
+	QuoteProvider       string        `config:"quote_provider" help:"one of socket, http or simulated, defaults to socket (http when DEBUG=TRUE)"`
+	QuoteServer         string        `config:"quote_server" help:"address of the socket or http quote server, defaults to the provider's"`
+	QuoteSeed           int64         `config:"quote_seed" help:"seed for the simulated quote provider"`
+	QuoteCacheTTL       time.Duration `config:"quote_cache_ttl" default:"60s" help:"how long a quote is reused for"`
+	TriggerInterval     time.Duration `config:"trigger_interval" default:"10s" help:"how often each watched stock is quoted for its triggers"`
+	ShutdownTimeout     time.Duration `config:"shutdown_timeout" default:"30s" help:"how long to wait for running requests and triggers when stopping"`
+	LogLevel            string        `config:"log_level" default:"info" help:"lowest level to log, one of debug, info, warn or error. Can be changed at /admin/log_level"`
+	AdminToken          string        `config:"admin_token" secret:"true" help:"bearer token /admin/log_level requires. It's disabled without one"`
+	TraceExporter       string        `config:"trace_exporter" default:"none" help:"where to send trace spans, one of none, otlp or file"`
+	TraceTarget         string        `config:"trace_target" help:"host:port of the OTLP/HTTP collector, or the file to write spans to, defaults to the exporter's"`
+}
+
+func (c *transactionConfig) Validate() error {
+	// DEBUG=TRUE selected the debug quote server before QUOTE_PROVIDER existed
+	if c.QuoteProvider == "" {
+		c.QuoteProvider = "socket"
+		if os.Getenv("DEBUG") == "TRUE" {
+			c.QuoteProvider = "http"
+		}
+	}
+
+	checks := []error{
+		config.CheckPort("port", c.Port),
+		config.CheckOneOf("database", c.Database, "crate", "postgres", "memory"),
+		config.CheckHostPort("redis_addr", c.RedisAddr),
+		config.CheckURL("audit_url", c.AuditURL, "http", "https"),
+		config.CheckAtLeast("audit_queue_size", c.AuditQueueSize, 1),
+		config.CheckAtLeast("audit_workers", c.AuditWorkers, 1),
+		config.CheckAtLeast("audit_batch_size", c.AuditBatchSize, 1),
+		config.CheckPositive("audit_batch_interval", c.AuditBatchInterval),
+		config.CheckPositive("audit_enqueue_timeout", c.AuditEnqueueTimeout),
+		config.CheckOneOf("quote_provider", c.QuoteProvider, "socket", "http", "simulated"),
+		config.CheckPositive("quote_cache_ttl", c.QuoteCacheTTL),
+		config.CheckPositive("trigger_interval", c.TriggerInterval),
+		config.CheckPositive("shutdown_timeout", c.ShutdownTimeout),
+		config.CheckOneOf("log_level", c.LogLevel, logging.Levels...),
+		tracing.CheckSettings(c.TraceExporter, &c.TraceTarget),
+	}
+	if c.AuditSpoolFile == "" {
+		checks = append(checks, errors.New("audit_spool_file: must be set, or events could be lost"))
+	}
+	if c.DatabaseURL != "" && c.Database == "crate" {
+		checks = append(checks, config.CheckURL("database_url", c.DatabaseURL, "http", "https"))
+	}
+	if c.DatabaseURL != "" && c.Database == "postgres" {
+		checks = append(checks, config.CheckURL("database_url", c.DatabaseURL, "postgres", "postgresql"))
+	}
+	if c.QuoteServer != "" && c.QuoteProvider == "socket" {
+		checks = append(checks, config.CheckHostPort("quote_server", c.QuoteServer))
+	}
+	if c.QuoteServer != "" && c.QuoteProvider == "http" {
+		checks = append(checks, config.CheckURL("quote_server", c.QuoteServer, "http", "https"))
+	}
+	return config.Check(checks...)
+}
+
+// Loaded by main before anything else is set up
+var (
+	cfg      transactionConfig
+	settings *config.Loaded
+)
+
+// Loads the config from the given arguments, the environment and the config file. Exits if it's invalid.
+func loadConfig(args []string) (transactionConfig, *config.Loaded) {
+	var c transactionConfig
+	logging.Init("transaction-server")
+	loaded, err := config.Load(&c, "transaction-server", args)
+	if err != nil {
+		slog.Error("Invalid config", "error", err)
+		os.Exit(2)
+	}
+	logging.SetLevel(c.LogLevel)
+	return c, loaded
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+// The command being processed, recorded with any error event it produces
+type commandInfo struct {
+	TransactionNum int
+	Command        string // the audit log command, e.g. "BUY" or "SET_SELL_TRIGGER"
+	UserID         string
+	Symbol         string
+	Funds          money.Money
+}
+
+// Logs the error and records it as an ErrorEvent in the audit log. Commands the client got wrong are
+// logged as warnings, and failures of the server or its dependencies as errors.
+// Parameters:
+// 		ctx: 	the context the command runs in
+// 		cmd: 	the command that was rejected or failed
+// 		err:	the reason it failed
+// 		msg:	what the command was doing when it failed
+//
+func reportError(ctx context.Context, cmd commandInfo, err error, msg string) {
+	level := slog.LevelError
+	if status, _ := errorStatus(err); status < http.StatusInternalServerError {
+		level = slog.LevelWarn
+	}
+	logger := logging.ForCommand(ctx, cmd.UserID, cmd.TransactionNum, cmd.Command)
+	if cmd.Symbol != "" {
+		logger = logger.With("symbol", cmd.Symbol)
+	}
+	logger.Log(ctx, level, msg, "error", err)
+
+	if cmd.Command == "" {
+		// The request failed before we knew which command it was, so there's nothing to audit
+		return
+	}
+	logErrorEvent(ctx, cmd.TransactionNum, "transaction-server", cmd.Command, cmd.UserID, cmd.Symbol, "", cmd.Funds, msg+": "+err.Error())
+}
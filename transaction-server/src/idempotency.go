@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+	"github.com/go-redis/redis"
+)
+
+// How long the outcome of a command is kept for duplicate submissions to replay
+const processedCommandTTL = 24 * time.Hour
+
+var (
+	// A different command was sent with a (UserID, TransactionNum) that was already used
+	errDuplicateTransaction = errors.New("transaction number was already used by another command")
+
+	// Redis couldn't say whether the command already ran
+	errIdempotencyUnavailable = errors.New("can't check whether the command already ran")
+)
+
+// The outcome of a command, replayed when the same (UserID, TransactionNum) is submitted again
+type processedCommand struct {
+	Path        string // the command's route. A different command with the same key is refused, not replayed
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+func processedCommandKey(UserID string, transactionNum int) string {
+	return "processed:" + UserID + ":" + strconv.Itoa(transactionNum)
+}
+
+// Captures the status and body a handler writes while passing them through to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Wraps a handler so each (UserID, TransactionNum) is only executed once. A duplicate submission gets
+// the stored response of the first one instead, and a different command that reuses the key is refused.
+// The key is the UserID and TransactionNum tracing.Middleware has read from the request's body. Requests
+// without a TransactionNum always run.
+// Must run inside serializeByUser so a duplicate can't start before the original has finished.
+//
+// Every outcome is stored, failures included, since a command that failed part way may already have
+// changed the account. Retrying a failed command takes a new TransactionNum. If Redis can't be reached,
+// the command is refused rather than risk running it twice.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := tracing.CommandFrom(r.Context())
+		if req.UserID == "" || req.TransactionNum == 0 {
+			handler(w, r)
+			return
+		}
+		key := processedCommandKey(req.UserID, req.TransactionNum)
+		cmd := commandInfo{TransactionNum: req.TransactionNum, Command: strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/")), UserID: req.UserID}
+
+		stored, err := cache.Get(key).Bytes()
+		if err == nil {
+			var processed processedCommand
+			if err := json.Unmarshal(stored, &processed); err == nil {
+				if processed.Path != r.URL.Path {
+					writeError(w, r, cmd, fmt.Errorf("%w: %s", errDuplicateTransaction, processed.Path), "Failed to run command")
+					return
+				}
+				if processed.ContentType != "" {
+					w.Header().Set("Content-Type", processed.ContentType)
+				}
+				w.Header().Set("Idempotent-Replay", "true")
+				w.WriteHeader(processed.Status)
+				w.Write(processed.Body)
+				return
+			}
+		} else if err != redis.Nil {
+			writeError(w, r, cmd, fmt.Errorf("%w: %s", errIdempotencyUnavailable, err), "Failed to check for a processed command")
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		handler(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		processed, _ := json.Marshal(processedCommand{r.URL.Path, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes()})
+		err = cache.Set(key, processed, processedCommandTTL).Err()
+		failGracefully(err, "Failed to store processed command")
+	}
+}
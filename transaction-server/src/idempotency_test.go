@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+	"github.com/go-redis/redis"
+)
+
+func TestIdempotentRefusesWithoutRedis(t *testing.T) {
+	// A closed client fails every command, the same as one whose Redis is down
+	saved := cache
+	cache = redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	cache.Close()
+	defer func() { cache = saved }()
+
+	ran := false
+	h := tracing.Middleware(idempotent(func(w http.ResponseWriter, r *http.Request) { ran = true }))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/add", strings.NewReader(`{"UserID": "alice", "Amount": 10, "TransactionNum": 1}`)))
+
+	if ran {
+		t.Error("ran the command without knowing whether it already had")
+	}
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "idempotency_unavailable") {
+		t.Errorf("replied %d %s, want %d idempotency_unavailable", w.Code, w.Body.String(), http.StatusServiceUnavailable)
+	}
+}
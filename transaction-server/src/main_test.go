@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+// The tests run against the in-memory store. Triggers are stored but never watched, so no quotes are fetched.
+func TestMain(m *testing.M) {
+	cfg, settings = loadConfig([]string{"-database", "memory"})
+	connect()
+	triggers.stop(context.Background())
+	os.Exit(m.Run())
+}
+
+// Replaces the store with an empty in-memory one
+func resetStore(t *testing.T) {
+	t.Helper()
+	store = newMemoryStore()
+}
+
+func balanceOf(t *testing.T, UserID string) money.Money {
+	t.Helper()
+	balance, err := store.Users.Balance(UserID)
+	if err != nil && err != errNoUser {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func sharesOf(t *testing.T, UserID string, Symbol string) int {
+	t.Helper()
+	holdings, err := store.Holdings.List(UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range holdings {
+		if h.Symbol == Symbol {
+			return h.Quantity
+		}
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/LeeZeitz/DayTradingSystem/shared/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The transaction server's own metrics. Request counts, request latency and database query latency
+// are recorded by the shared metrics package.
+var (
+	quoteCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "quote_cache_lookups_total",
+		Help:      "Quote cache lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	quoteServerDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "quote_server_duration_seconds",
+		Help:      "How long quotes took to retrieve from the quote provider, including failures.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	quoteServerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "quote_server_errors_total",
+		Help:      "Quotes the quote provider failed to return.",
+	})
+
+	triggerFires = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "trigger_fires_total",
+		Help:      "Triggers that reached their price and fired, by method.",
+	}, []string{"method"})
+
+	auditPostFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_post_failures_total",
+		Help:      "Audit events that failed to be sent to the audit server, by endpoint. Failed batches count each of their events.",
+	}, []string{"endpoint"})
+
+	auditPostRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_post_retries_total",
+		Help:      "Audit events sent to the audit server again after failing, by endpoint.",
+	}, []string{"endpoint"})
+
+	auditEventsSpooled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_events_spooled_total",
+		Help:      "Audit events written to the spool file because the queue was full or the server was stopping.",
+	})
+
+	auditEventsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_events_rejected_total",
+		Help:      "Audit events the audit server couldn't parse, which were logged instead of stored.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_queue_depth",
+		Help:      "Audit events waiting in the queue for a worker to send them.",
+	}, func() float64 { return float64(len(audits.queue)) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_queue_capacity",
+		Help:      "Audit events the queue can hold before logging an event has to wait.",
+	}, func() float64 { return float64(cap(audits.queue)) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_events_pending",
+		Help:      "Audit events queued or being sent that the audit server hasn't stored yet.",
+	}, func() float64 { return float64(audits.pending()) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "active_triggers",
+		Help:      "Triggers being watched.",
+	}, func() float64 { return float64(triggers.count()) })
+)
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/migrate"
+)
+
+// The transaction database's schema, oldest first. Never edit a migration once it's been released; add a new one.
+// Migration 1 is the schema the service started with. Databases created before migrations existed already have
+// it, so it only creates what's missing and the migrations after it bring them up to date.
+var migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "create tables",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS users(
+				user_id TEXT,
+				balance FLOAT,
+				PRIMARY KEY (user_id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS stocks(
+				user_id TEXT,
+				symbol TEXT,
+				quantity INTEGER,
+				PRIMARY KEY (user_id, symbol)
+			);`,
+			`CREATE TABLE IF NOT EXISTS buy_amounts(
+				user_id TEXT,
+				symbol TEXT,
+				quantity INTEGER,
+				PRIMARY KEY (user_id, symbol)
+			);`,
+			`CREATE TABLE IF NOT EXISTS sell_amounts(
+				user_id TEXT,
+				symbol TEXT,
+				quantity INTEGER,
+				PRIMARY KEY (user_id, symbol)
+			);`,
+			`CREATE TABLE IF NOT EXISTS triggers(
+				user_id TEXT,
+				symbol TEXT,
+				price FLOAT,
+				method TEXT,
+				transaction_num INTEGER,
+				PRIMARY KEY (user_id, symbol, method)
+			);`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS triggers;",
+			"DROP TABLE IF EXISTS sell_amounts;",
+			"DROP TABLE IF EXISTS buy_amounts;",
+			"DROP TABLE IF EXISTS stocks;",
+			"DROP TABLE IF EXISTS users;",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add reservations",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS reserved_funds(
+				reservation_id TEXT,
+				user_id TEXT,
+				amount FLOAT,
+				PRIMARY KEY (reservation_id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS reserved_shares(
+				reservation_id TEXT,
+				user_id TEXT,
+				symbol TEXT,
+				quantity INTEGER,
+				PRIMARY KEY (reservation_id)
+			);`,
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS reserved_shares;",
+			"DROP TABLE IF EXISTS reserved_funds;",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "store money in cents",
+		Up: migrate.Join(
+			migrate.ConvertTable("users", []migrate.Column{
+				{Name: "user_id", Type: "TEXT"},
+				{Name: "balance", Type: "BIGINT", From: "CAST(ROUND(balance * 100) AS BIGINT)"},
+			}, "user_id"),
+			migrate.ConvertTable("triggers", []migrate.Column{
+				{Name: "user_id", Type: "TEXT"},
+				{Name: "symbol", Type: "TEXT"},
+				{Name: "price", Type: "BIGINT", From: "CAST(ROUND(price * 100) AS BIGINT)"},
+				{Name: "method", Type: "TEXT"},
+				{Name: "transaction_num", Type: "INTEGER"},
+			}, "user_id, symbol, method"),
+			migrate.ConvertTable("reserved_funds", []migrate.Column{
+				{Name: "reservation_id", Type: "TEXT"},
+				{Name: "user_id", Type: "TEXT"},
+				{Name: "amount", Type: "BIGINT", From: "CAST(ROUND(amount * 100) AS BIGINT)"},
+			}, "reservation_id"),
+		),
+		Down: migrate.Join(
+			migrate.ConvertTable("users", []migrate.Column{
+				{Name: "user_id", Type: "TEXT"},
+				{Name: "balance", Type: "FLOAT", From: "CAST(balance AS FLOAT) / 100"},
+			}, "user_id"),
+			migrate.ConvertTable("triggers", []migrate.Column{
+				{Name: "user_id", Type: "TEXT"},
+				{Name: "symbol", Type: "TEXT"},
+				{Name: "price", Type: "FLOAT", From: "CAST(price AS FLOAT) / 100"},
+				{Name: "method", Type: "TEXT"},
+				{Name: "transaction_num", Type: "INTEGER"},
+			}, "user_id, symbol, method"),
+			migrate.ConvertTable("reserved_funds", []migrate.Column{
+				{Name: "reservation_id", Type: "TEXT"},
+				{Name: "user_id", Type: "TEXT"},
+				{Name: "amount", Type: "FLOAT", From: "CAST(amount AS FLOAT) / 100"},
+			}, "reservation_id"),
+		),
+	},
+	{
+		// Buy amounts were a whole number of dollars. They can't go back without losing cents, so there's no Down
+		Version: 4,
+		Name:    "store buy amounts in cents",
+		Up:      migrate.ConvertTable("buy_amounts", amountInCents, "user_id, symbol"),
+	},
+	{
+		Version: 5,
+		Name:    "store sell amounts in cents",
+		Up:      migrate.ConvertTable("sell_amounts", amountInCents, "user_id, symbol"),
+	},
+}
+
+// The columns of buy_amounts and sell_amounts once their whole dollar quantity is an amount in cents
+var amountInCents = []migrate.Column{
+	{Name: "user_id", Type: "TEXT"},
+	{Name: "symbol", Type: "TEXT"},
+	{Name: "amount", Type: "BIGINT", From: "CAST(quantity AS BIGINT) * 100"},
+}
+
+// Runs "transaction-server migrate ..." against the database selected by DATABASE and DATABASE_URL
+func migrateCommand(args []string) {
+	if store.Schema == nil {
+		slog.Error("The in-memory store has no schema to migrate")
+		os.Exit(1)
+	}
+	if err := migrate.Command(store.Schema, args); err != nil {
+		slog.Error("Failed to migrate", "error", err)
+		os.Exit(1)
+	}
+}
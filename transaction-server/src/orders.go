@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/go-redis/redis"
+)
+
+// How long a BUY or SELL can wait for a COMMIT after its quote was retrieved
+const orderTimeout = 60 * time.Second
+
+// Sorted set indexing every pending order by the time (unix ms) it expires
+const pendingOrdersKey = "pending_orders"
+
+var (
+	errNoPendingOrder = errors.New("no pending order exists")
+	errOrderExpired   = errors.New("pending order has expired")
+)
+
+// A BUY or SELL that is waiting to be committed or cancelled.
+// Orders are stored JSON encoded in the user's "<user_id>:buy" and "<user_id>:sell" Redis lists.
+type pendingOrder struct {
+	UserID         string
+	Method         string      // "buy" or "sell"
+	Symbol         string      // symbol of the stock to buy or sell
+	Quantity       int         // number of shares to buy or sell
+	Price          money.Money // quoted price of a single share
+	Amount         money.Money // total cost of a buy or proceeds of a sell
+	ReservationID  string      // reservation holding the funds or shares for the order
+	QuoteTime      int64       // time (unix ms) the quote for the order was retrieved
+	TransactionNum int
+}
+
+// Returns the time (unix ms) after which the order can no longer be committed
+func (o pendingOrder) expiresAt() int64 {
+	return o.QuoteTime + int64(orderTimeout/time.Millisecond)
+}
+
+func (o pendingOrder) expired() bool {
+	return createTimestamp() >= o.expiresAt()
+}
+
+func pendingOrderKey(UserID string, method string) string {
+	return UserID + ":" + method
+}
+
+// Adds an order to the front of the user's pending order list
+func pushPendingOrder(order pendingOrder) error {
+	b, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	member := string(b)
+
+	// Index the order first so the sweeper can always find it
+	err = cache.ZAdd(pendingOrdersKey, redis.Z{Score: float64(order.expiresAt()), Member: member}).Err()
+	if err != nil {
+		return err
+	}
+	err = cache.LPush(pendingOrderKey(order.UserID, order.Method), member).Err()
+	if err != nil {
+		cache.ZRem(pendingOrdersKey, member)
+	}
+	return err
+}
+
+// Removes and returns the user's most recent pending order.
+// If the order has expired, its reservation is released and errOrderExpired is returned.
+// Parameters:
+// 		ctx: 			the context of the command taking the order
+// 		UserID: 		id of the user who owns the order
+//		method:			the type of order, one of ("buy", "sell")
+//
+func popPendingOrder(ctx context.Context, UserID string, method string) (pendingOrder, error) {
+	var order pendingOrder
+
+	member, err := cache.LPop(pendingOrderKey(UserID, method)).Result()
+	if err == redis.Nil {
+		return order, errNoPendingOrder
+	}
+	if err != nil {
+		return order, err
+	}
+	cache.ZRem(pendingOrdersKey, member)
+
+	err = json.Unmarshal([]byte(member), &order)
+	if err != nil {
+		return order, err
+	}
+
+	if order.expired() {
+		expireOrder(ctx, order)
+		return order, errOrderExpired
+	}
+	return order, nil
+}
+
+// Puts back an order whose reservation couldn't be settled or released after it was popped, so it can be
+// committed or cancelled again, or expire as usual. If it can't be put back, its reservation is released
+// instead. Does nothing if the reservation is already gone.
+// Parameters:
+// 		ctx: 		the context of the command that popped it
+// 		order: 		the order that was popped
+//		cause:		why its reservation couldn't be settled or released
+//
+func restorePendingOrder(ctx context.Context, order pendingOrder, cause error) {
+	if errors.Is(cause, errNoReservation) {
+		return
+	}
+	err := pushPendingOrder(order)
+	if err != nil {
+		failGracefully(err, "Failed to restore pending order")
+		expireOrder(ctx, order)
+	}
+}
+
+// Releases the funds or shares reserved for an order that was not committed in time
+func expireOrder(ctx context.Context, order pendingOrder) {
+	cmd := commandInfo{order.TransactionNum, strings.ToUpper(order.Method), order.UserID, order.Symbol, order.Amount}
+
+	if order.Method == "buy" {
+		refund, err := ReleaseFunds(order.UserID, order.ReservationID)
+		if err != nil {
+			reportError(ctx, cmd, err, "Failed to release funds for expired buy order")
+			return
+		}
+		logAccountTransaction(ctx, order.TransactionNum, "transaction-server", "release", order.UserID, refund)
+		logSystemEvent(ctx, order.TransactionNum, "transaction-server", "CANCEL_BUY", order.UserID, order.Symbol, "", refund)
+	} else {
+		quantity, err := ReleaseShares(order.UserID, order.ReservationID)
+		if err != nil {
+			reportError(ctx, cmd, err, "Failed to release shares for expired sell order")
+			return
+		}
+		logAccountTransaction(ctx, order.TransactionNum, "transaction-server", "release", order.UserID, order.Price.Mul(quantity))
+		logSystemEvent(ctx, order.TransactionNum, "transaction-server", "CANCEL_SELL", order.UserID, order.Symbol, "", order.Amount)
+	}
+}
+
+// Expires every pending order whose timeout has passed
+func sweepExpiredOrders() {
+	members, err := cache.ZRangeByScore(pendingOrdersKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(createTimestamp(), 10),
+	}).Result()
+	if err != nil {
+		failGracefully(err, "Failed to get expired orders")
+		return
+	}
+
+	// Each order waits on its user's queue, so one user's slow command doesn't hold up everyone else's expiry
+	var expiring sync.WaitGroup
+	defer expiring.Wait()
+	for _, member := range members {
+		var order pendingOrder
+		err = json.Unmarshal([]byte(member), &order)
+		cache.ZRem(pendingOrdersKey, member)
+		if err != nil {
+			failGracefully(err, "Failed to parse expired order")
+			continue
+		}
+
+		// Run on the user's queue so the order can't be expired while one of their commands is using it
+		member := member
+		expiring.Add(1)
+		go func() {
+			defer expiring.Done()
+			err := userQueues.run(order.UserID, func() {
+				// Only release the order if it was still pending. If it's already gone, a COMMIT or CANCEL took it
+				removed, err := cache.LRem(pendingOrderKey(order.UserID, order.Method), 1, member).Result()
+				if err != nil {
+					failGracefully(err, "Failed to remove expired order")
+					return
+				}
+				if removed == 1 {
+					expireOrder(context.Background(), order)
+				}
+			})
+			if err != nil {
+				// Indexed again so the next sweep tries again
+				failGracefully(err, "Failed to wait for the user's commands to expire an order")
+				cache.ZAdd(pendingOrdersKey, redis.Z{Score: float64(order.expiresAt()), Member: member})
+			}
+		}()
+	}
+}
+
+// Periodically expires pending orders that were never committed or cancelled
+type orderSweeper struct {
+	stopping chan struct{}
+	stopped  chan struct{}
+}
+
+// Starts sweeping expired orders every second
+func startOrderSweeper() *orderSweeper {
+	s := &orderSweeper{make(chan struct{}), make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *orderSweeper) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ticker.C:
+			sweepExpiredOrders()
+		}
+	}
+}
+
+// Stops sweeping and waits for a sweep in progress to finish, or for the context to be done.
+// Orders that expire after this are swept by the next server to start.
+func (s *orderSweeper) stop(ctx context.Context) {
+	close(s.stopping)
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		slog.Warn("Gave up waiting for the expired order sweep to finish")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+const (
+	quoteDialTimeout  = 2 * time.Second
+	quoteReadTimeout  = 3 * time.Second
+	quoteRetries      = 3                      // attempts after the first one fails
+	quoteBackoff      = 100 * time.Millisecond // doubled after every failed attempt
+	maxQuoteLineBytes = 1024
+
+	// The longest a fetch can take: every attempt timing out on both its dial and its read, plus the
+	// backoff between them. Fetches are cut off at this, so a quote lock held for longer is never outlived.
+	quoteFetchTimeout = (quoteRetries+1)*(quoteDialTimeout+quoteReadTimeout) + quoteBackoff*(1<<quoteRetries-1)
+)
+
+var (
+	errQuoteTimeout     = errors.New("quote server timed out")
+	errQuoteUnavailable = errors.New("quote server unavailable")
+	errQuoteTooLong     = errors.New("quote server response too long")
+)
+
+// Returned when the quote server's response can't be understood
+type QuoteParseError struct {
+	Response string // the raw response line
+	Reason   string
+}
+
+func (e *QuoteParseError) Error() string {
+	return fmt.Sprintf("malformed quote server response %q: %s", e.Response, e.Reason)
+}
+
+// A client for the legacy quote server's line protocol.
+// Every request uses a fresh connection with dial and read deadlines, and failed requests are
+// retried with exponential backoff.
+type quoteClient struct {
+	addr        string
+	dialTimeout time.Duration
+	readTimeout time.Duration
+	retries     int
+	backoff     time.Duration
+}
+
+func newQuoteClient(addr string) *quoteClient {
+	return &quoteClient{addr, quoteDialTimeout, quoteReadTimeout, quoteRetries, quoteBackoff}
+}
+
+// Retrieves a quote, retrying failed attempts until the context is done
+// Parameters:
+// 		ctx:			cancels the fetch, including an attempt that's in progress
+// 		symbol: 		symbol of the stock to quote
+// 		userID:			id of the user requesting the quote
+//
+func (c *quoteClient) Fetch(ctx context.Context, symbol string, userID string) (Quote, error) {
+	backoff := c.backoff
+	var err error
+
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return Quote{}, classifyNetError(ctx.Err())
+			}
+			backoff *= 2
+		}
+
+		var quote Quote
+		quote, err = c.fetchOnce(ctx, symbol, userID)
+		if err == nil {
+			return quote, nil
+		}
+		if ctx.Err() != nil {
+			return Quote{}, classifyNetError(ctx.Err())
+		}
+		failGracefully(err, fmt.Sprintf("Quote attempt %d for %s failed", attempt+1, symbol))
+	}
+	return Quote{}, err
+}
+
+func (c *quoteClient) fetchOnce(ctx context.Context, symbol string, userID string) (Quote, error) {
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return Quote{}, classifyNetError(err)
+	}
+	defer conn.Close()
+
+	// One deadline covers both sending the request and reading the response. Cancelling the context
+	// moves it to now, which interrupts a read that's blocked.
+	deadline := time.Now().Add(c.readTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	_, err = conn.Write([]byte(fmt.Sprintf("%s,%s\r", symbol, userID)))
+	if err != nil {
+		return Quote{}, classifyNetError(err)
+	}
+
+	line, err := readQuoteLine(bufio.NewReaderSize(conn, maxQuoteLineBytes))
+	if err != nil {
+		return Quote{}, err
+	}
+	return parseQuote(line, symbol, userID)
+}
+
+// Reads a single response line, up to the "\n" terminator.
+// A server that closes the connection after an unterminated response is tolerated.
+func readQuoteLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errQuoteTooLong
+	}
+	if err != nil && !(err == io.EOF && len(line) > 0) {
+		return "", classifyNetError(err)
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Parses a "price,symbol,user,timestamp,cryptokey" response, checking it answers the request that was made
+func parseQuote(line string, symbol string, userID string) (Quote, error) {
+	spl := strings.Split(line, ",")
+	if len(spl) != 5 {
+		return Quote{}, &QuoteParseError{line, fmt.Sprintf("expected 5 fields, got %d", len(spl))}
+	}
+
+	price, err := money.Parse(spl[0])
+	if err != nil || price <= 0 {
+		return Quote{}, &QuoteParseError{line, "invalid price"}
+	}
+	if strings.TrimSpace(spl[1]) != symbol {
+		return Quote{}, &QuoteParseError{line, "quote is for the wrong symbol"}
+	}
+	if strings.TrimSpace(spl[2]) != userID {
+		return Quote{}, &QuoteParseError{line, "quote is for the wrong user"}
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(spl[3]), 10, 64)
+	if err != nil {
+		return Quote{}, &QuoteParseError{line, "invalid timestamp"}
+	}
+	cryptoKey := strings.TrimSpace(spl[4])
+	if cryptoKey == "" {
+		return Quote{}, &QuoteParseError{line, "missing crypto key"}
+	}
+
+	return Quote{symbol, userID, price, timestamp, cryptoKey}, nil
+}
+
+// Wraps network and context errors in errQuoteTimeout or errQuoteUnavailable
+func classifyNetError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", errQuoteTimeout, err)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("%w: %s", errQuoteTimeout, err)
+	}
+	return fmt.Errorf("%w: %s", errQuoteUnavailable, err)
+}
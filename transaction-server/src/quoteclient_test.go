@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseQuote(t *testing.T) {
+	tests := []struct {
+		line string
+		want Quote
+	}{
+		{"12.34,ABC,alice,1520000000000,key=", Quote{"ABC", "alice", 1234, 1520000000000, "key="}},
+		{"7, ABC , alice ,1520000000000, key= ", Quote{"ABC", "alice", 700, 1520000000000, "key="}},
+		{"0.015,ABC,alice,1,k", Quote{"ABC", "alice", 2, 1, "k"}},
+	}
+	for _, tt := range tests {
+		got, err := parseQuote(tt.line, "ABC", "alice")
+		if err != nil {
+			t.Errorf("parseQuote(%q) returned error %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseQuote(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseQuoteInvalid(t *testing.T) {
+	tests := []struct {
+		line   string
+		reason string
+	}{
+		{"", "expected 5 fields, got 1"},
+		{"12.34,ABC,alice,1520000000000", "expected 5 fields, got 4"},
+		{"12.34,ABC,alice,1520000000000,key,extra", "expected 5 fields, got 6"},
+		{"abc,ABC,alice,1520000000000,key", "invalid price"},
+		{"0,ABC,alice,1520000000000,key", "invalid price"},
+		{"-1,ABC,alice,1520000000000,key", "invalid price"},
+		{"12.34,XYZ,alice,1520000000000,key", "quote is for the wrong symbol"},
+		{"12.34,ABC,bob,1520000000000,key", "quote is for the wrong user"},
+		{"12.34,ABC,alice,yesterday,key", "invalid timestamp"},
+		{"12.34,ABC,alice,1520000000000, ", "missing crypto key"},
+	}
+	for _, tt := range tests {
+		_, err := parseQuote(tt.line, "ABC", "alice")
+		var parseErr *QuoteParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("parseQuote(%q) returned %v, want a QuoteParseError", tt.line, err)
+			continue
+		}
+		if parseErr.Reason != tt.reason {
+			t.Errorf("parseQuote(%q) failed with %q, want %q", tt.line, parseErr.Reason, tt.reason)
+		}
+	}
+}
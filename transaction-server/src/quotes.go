@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+)
+
+// A single stock quote retrieved from a quote provider
+type Quote struct {
+	Symbol          string
+	UserID          string
+	Price           money.Money
+	QuoteServerTime int64 // time the quote server produced the quote
+	CryptoKey       string
+}
+
+// A source of stock quotes
+type QuoteProvider interface {
+	// The context carries the trace of the command that wants the quote
+	GetQuote(ctx context.Context, symbol string, userID string) (Quote, error)
+	// Checks that the provider can be reached, without retrieving a quote
+	Ping(ctx context.Context) error
+}
+
+// Chooses the quote provider from the config
+func loadQuoteProvider() QuoteProvider {
+	provider, err := newQuoteProvider(cfg.QuoteProvider, cfg.QuoteServer, cfg.QuoteSeed)
+	if err != nil {
+		failGracefully(err, "Invalid quote provider, using the legacy quote server")
+		provider, _ = newQuoteProvider("socket", "", 0)
+	}
+	return provider
+}
+
+// Creates a quote provider
+// Parameters:
+// 		name: 		the type of provider, one of ("socket", "http", "simulated")
+// 		addr:		the address of the quote server. Uses the provider's default when empty
+// 		seed:		the seed for the simulated provider's market
+//
+func newQuoteProvider(name string, addr string, seed int64) (QuoteProvider, error) {
+	switch name {
+	case "", "socket":
+		if addr == "" {
+			addr = "quoteserve.seng.uvic.ca:4452"
+		}
+		return &socketQuoteProvider{newQuoteClient(addr)}, nil
+	case "http":
+		if addr == "" {
+			addr = "http://localhost:3000/quote"
+		}
+		return &httpQuoteProvider{addr}, nil
+	case "simulated":
+		return newSimulatedQuoteProvider(seed), nil
+	}
+	return nil, fmt.Errorf("unknown quote provider %q", name)
+}
+
+// Retrieves quotes from the legacy quote server over a raw TCP socket.
+// The request is "SYMBOL,USERID\r" and the response is "price,symbol,user,timestamp,cryptokey".
+type socketQuoteProvider struct {
+	client *quoteClient
+}
+
+func (p *socketQuoteProvider) GetQuote(ctx context.Context, symbol string, userID string) (Quote, error) {
+	return p.client.Fetch(ctx, symbol, userID)
+}
+
+func (p *socketQuoteProvider) Ping(ctx context.Context) error {
+	return dialCheck(ctx, p.client.addr)
+}
+
+// Retrieves quotes from the debug quote server (quoteServer.py) over HTTP
+type httpQuoteProvider struct {
+	url string
+}
+
+var quoteHTTPClient = &http.Client{Transport: tracing.Transport, Timeout: quoteDialTimeout + quoteReadTimeout}
+
+func (p *httpQuoteProvider) GetQuote(ctx context.Context, symbol string, userID string) (Quote, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return Quote{}, err
+	}
+	r, err := quoteHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return Quote{}, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return Quote{}, fmt.Errorf("%w: %s", errQuoteUnavailable, r.Status)
+	}
+
+	res := struct {
+		CryptoKey string
+		Quote     money.Money
+	}{"", 0}
+
+	err = json.NewDecoder(r.Body).Decode(&res)
+	if err != nil {
+		return Quote{}, err
+	}
+	return Quote{symbol, userID, res.Quote, createTimestamp(), res.CryptoKey}, nil
+}
+
+// Connects to the quote server's host without asking for a quote, since every request to it is a quote
+func (p *httpQuoteProvider) Ping(ctx context.Context) error {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "80")
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	return dialCheck(ctx, addr)
+}
+
+// An in-process market where every stock's price follows its own random walk.
+// Each symbol starts at a price derived from its name, so a given seed always produces the same market.
+type simulatedQuoteProvider struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	prices map[string]money.Money
+}
+
+func newSimulatedQuoteProvider(seed int64) *simulatedQuoteProvider {
+	return &simulatedQuoteProvider{
+		rand:   rand.New(rand.NewSource(seed)),
+		prices: map[string]money.Money{},
+	}
+}
+
+func (p *simulatedQuoteProvider) GetQuote(ctx context.Context, symbol string, userID string) (Quote, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	price, ok := p.prices[symbol]
+	if !ok {
+		// Start somewhere between $10 and $500
+		h := fnv.New32a()
+		h.Write([]byte(symbol))
+		price = money.FromCents(1000 + int64(h.Sum32()%49000))
+	} else {
+		// Move up to 2% in either direction, but never below a cent
+		price = money.FromFloat(price.Float64() * (1 + (p.rand.Float64()*0.04 - 0.02)))
+		if price < 1 {
+			price = 1
+		}
+	}
+	p.prices[symbol] = price
+
+	key := make([]byte, 16)
+	p.rand.Read(key)
+	return Quote{symbol, userID, price, createTimestamp(), hex.EncodeToString(key)}, nil
+}
+
+// The simulated market is always reachable
+func (p *simulatedQuoteProvider) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Opens and closes a TCP connection to the address
+func dialCheck(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+var (
+	errInsufficientFunds  = errors.New("insufficient funds")
+	errInsufficientShares = errors.New("insufficient shares")
+	errNoReservation      = errors.New("reservation does not exist")
+	errReservationBusy    = errors.New("reservation was modified concurrently")
+)
+
+// Creates a unique id for a reservation held by a single pending order
+// Parameters:
+// 		UserID: 		the id of the user the reservation belongs to
+// 		kind:			the kind of order holding the reservation, e.g. "buy" or "sell"
+// 		transactionNum:	the transaction number of the command creating the reservation
+//
+func newReservationID(UserID string, kind string, transactionNum int) string {
+	return fmt.Sprintf("%s:%s:%d:%d", kind, UserID, transactionNum, time.Now().UnixNano())
+}
+
+// Returns the id of the reservation held by a user's buy amount for a stock.
+// SET_BUY_AMOUNT adds to this reservation, so there is only ever one per user and symbol.
+func buyAmountReservationID(UserID string, Symbol string) string {
+	return "buy_amount:" + UserID + ":" + Symbol
+}
+
+// Returns the id of the reservation holding the shares for a user's sell trigger on a stock
+func sellAmountReservationID(UserID string, Symbol string) string {
+	return "sell_amount:" + UserID + ":" + Symbol
+}
+
+// Reserves the given amount of money from the given user
+// The money is withdrawn from the user's balance and held in the reserved_funds ledger until it is
+// released back to the user or settled by a completed purchase.
+// Parameters:
+// 		UserID: 		the userID for the user to reserve funds from
+// 		reservationID:	the id of the reservation to hold the funds under
+// 		amount:			the amount of money to reserve
+//
+func ReserveFunds(UserID string, reservationID string, amount money.Money) error {
+	if amount < 0 {
+		return fmt.Errorf("can't reserve a negative amount: %s", amount)
+	}
+
+	// Only withdraw the money if the balance covers it
+	err := store.Users.Withdraw(UserID, amount)
+	if err != nil {
+		return err
+	}
+
+	// Record the reservation. If it already exists (e.g. a buy amount), add to it
+	err = store.Reservations.AddFunds(reservationID, UserID, amount)
+	if err != nil {
+		// Couldn't record the reservation, so give the money back
+		refundFunds(UserID, amount)
+		return err
+	}
+	return nil
+}
+
+// Releases a reservation and returns all of the money it holds to the user's balance
+// Parameters:
+// 		UserID: 		the userID for the user who owns the reservation
+// 		reservationID:	the id of the reservation to release
+//
+// Returns the amount of money that was returned to the user
+func ReleaseFunds(UserID string, reservationID string) (money.Money, error) {
+	amount, err := store.Reservations.TakeFunds(reservationID, UserID)
+	if err != nil {
+		return 0, err
+	}
+	err = refundFunds(UserID, amount)
+	return amount, err
+}
+
+// Returns part of the money a reservation holds to the user's balance. The rest stays reserved.
+// Parameters:
+// 		UserID: 		the userID for the user who owns the reservation
+// 		reservationID:	the id of the reservation to release from
+// 		amount:			the amount of money to return. Capped at what the reservation holds
+//
+// Returns the amount of money that was returned to the user
+func ReleaseSomeFunds(UserID string, reservationID string, amount money.Money) (money.Money, error) {
+	held, err := store.Reservations.TakeFunds(reservationID, UserID)
+	if err != nil {
+		return 0, err
+	}
+	if amount > held {
+		amount = held
+	}
+	if rest := held - amount; rest > 0 {
+		if err := store.Reservations.AddFunds(reservationID, UserID, rest); err != nil {
+			// The rest couldn't be put back, so rather than lose it the user gets all of it
+			failGracefully(err, "Failed to keep the rest of a reservation")
+			amount = held
+		}
+	}
+	err = refundFunds(UserID, amount)
+	return amount, err
+}
+
+// Settles a reservation once the purchase it was held for has been made. The money it holds is spent.
+// Parameters:
+// 		UserID: 		the userID for the user who owns the reservation
+// 		reservationID:	the id of the reservation to settle
+//
+// Returns the amount of money that was spent
+func SettleFunds(UserID string, reservationID string) (money.Money, error) {
+	return store.Reservations.TakeFunds(reservationID, UserID)
+}
+
+// Adds money back to a user's balance
+func refundFunds(UserID string, amount money.Money) error {
+	err := store.Users.Deposit(UserID, amount)
+	failGracefully(err, "Failed to refund reserved funds")
+	return err
+}
+
+// Reserves the given number of shares of a stock from the given user
+// The shares are removed from the user's holdings and held in the reserved_shares ledger until they
+// are released back to the user or settled by a completed sale.
+// Parameters:
+// 		UserID: 		the userID for the user to reserve shares from
+// 		reservationID:	the id of the reservation to hold the shares under
+// 		Symbol:			the symbol of the stock to reserve
+// 		quantity:		the number of shares to reserve
+//
+func ReserveShares(UserID string, reservationID string, Symbol string, quantity int) error {
+	if quantity < 0 {
+		return fmt.Errorf("can't reserve a negative number of shares: %d", quantity)
+	}
+
+	// Only remove the shares if the user owns enough of them
+	err := store.Holdings.Remove(UserID, Symbol, quantity)
+	if err != nil {
+		return err
+	}
+
+	err = store.Reservations.AddShares(reservationID, UserID, Symbol, quantity)
+	if err != nil {
+		// Couldn't record the reservation, so give the shares back
+		refundShares(UserID, Symbol, quantity)
+		return err
+	}
+	return nil
+}
+
+// Releases a reservation and returns all of the shares it holds to the user's holdings
+// Parameters:
+// 		UserID: 		the userID for the user who owns the reservation
+// 		reservationID:	the id of the reservation to release
+//
+// Returns the number of shares that were returned to the user
+func ReleaseShares(UserID string, reservationID string) (int, error) {
+	symbol, quantity, err := store.Reservations.TakeShares(reservationID, UserID)
+	if err != nil {
+		return 0, err
+	}
+	err = refundShares(UserID, symbol, quantity)
+	return quantity, err
+}
+
+// Returns part of the shares a reservation holds to the user's holdings. The rest stay reserved.
+// Parameters:
+// 		UserID: 		the userID for the user who owns the reservation
+// 		reservationID:	the id of the reservation to release from
+// 		quantity:		the number of shares to return. Capped at what the reservation holds
+//
+// Returns the number of shares that were returned to the user
+func ReleaseSomeShares(UserID string, reservationID string, quantity int) (int, error) {
+	symbol, held, err := store.Reservations.TakeShares(reservationID, UserID)
+	if err != nil {
+		return 0, err
+	}
+	if quantity > held {
+		quantity = held
+	}
+	if rest := held - quantity; rest > 0 {
+		if err := store.Reservations.AddShares(reservationID, UserID, symbol, rest); err != nil {
+			// The rest couldn't be put back, so rather than lose them the user gets all of them
+			failGracefully(err, "Failed to keep the rest of a reservation")
+			quantity = held
+		}
+	}
+	err = refundShares(UserID, symbol, quantity)
+	return quantity, err
+}
+
+// Returns the number of shares a reservation holds, or 0 if it doesn't exist
+func heldShares(UserID string, reservationID string) (int, error) {
+	reservations, err := store.Reservations.ListShares(UserID)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range reservations {
+		if r.ReservationID == reservationID {
+			return r.Quantity, nil
+		}
+	}
+	return 0, nil
+}
+
+// Settles a reservation once the sale it was held for has been made. The shares it holds are sold.
+// Parameters:
+// 		UserID: 		the userID for the user who owns the reservation
+// 		reservationID:	the id of the reservation to settle
+//
+// Returns the number of shares that were sold
+func SettleShares(UserID string, reservationID string) (int, error) {
+	_, quantity, err := store.Reservations.TakeShares(reservationID, UserID)
+	return quantity, err
+}
+
+// Adds shares back to a user's holdings
+func refundShares(UserID string, Symbol string, quantity int) error {
+	err := store.Holdings.Add(UserID, Symbol, quantity)
+	failGracefully(err, "Failed to refund reserved shares")
+	return err
+}
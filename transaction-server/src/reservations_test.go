@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+func TestFundsLedger(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func() (money.Money, error)
+		err      error
+		returned money.Money // what the call returns
+		balance  money.Money
+		reserved money.Money
+	}{
+		{
+			name:     "reserve withdraws the money",
+			run:      func() (money.Money, error) { return 0, ReserveFunds("alice", "r1", 4000) },
+			balance:  6000,
+			reserved: 4000,
+		},
+		{
+			name: "reserve adds to an existing reservation",
+			run: func() (money.Money, error) {
+				ReserveFunds("alice", "r1", 1000)
+				return 0, ReserveFunds("alice", "r1", 2000)
+			},
+			balance:  7000,
+			reserved: 3000,
+		},
+		{
+			name:     "reserve needs the funds",
+			run:      func() (money.Money, error) { return 0, ReserveFunds("alice", "r1", 10001) },
+			err:      errInsufficientFunds,
+			balance:  10000,
+			reserved: 0,
+		},
+		{
+			name:     "reserve rejects a negative amount",
+			run:      func() (money.Money, error) { return 0, ReserveFunds("alice", "r1", -1) },
+			err:      errAny,
+			balance:  10000,
+			reserved: 0,
+		},
+		{
+			name: "release returns all of the money",
+			run: func() (money.Money, error) {
+				ReserveFunds("alice", "r1", 4000)
+				return ReleaseFunds("alice", "r1")
+			},
+			returned: 4000,
+			balance:  10000,
+		},
+		{
+			name:    "release needs a reservation",
+			run:     func() (money.Money, error) { return ReleaseFunds("alice", "r1") },
+			err:     errNoReservation,
+			balance: 10000,
+		},
+		{
+			name: "release some keeps the rest reserved",
+			run: func() (money.Money, error) {
+				ReserveFunds("alice", "r1", 4000)
+				return ReleaseSomeFunds("alice", "r1", 1500)
+			},
+			returned: 1500,
+			balance:  7500,
+			reserved: 2500,
+		},
+		{
+			name: "release some is capped at what's reserved",
+			run: func() (money.Money, error) {
+				ReserveFunds("alice", "r1", 4000)
+				return ReleaseSomeFunds("alice", "r1", 9000)
+			},
+			returned: 4000,
+			balance:  10000,
+		},
+		{
+			name: "settle spends the money",
+			run: func() (money.Money, error) {
+				ReserveFunds("alice", "r1", 4000)
+				return SettleFunds("alice", "r1")
+			},
+			returned: 4000,
+			balance:  6000,
+		},
+		{
+			name: "a reservation can only be settled once",
+			run: func() (money.Money, error) {
+				ReserveFunds("alice", "r1", 4000)
+				SettleFunds("alice", "r1")
+				return SettleFunds("alice", "r1")
+			},
+			err:     errNoReservation,
+			balance: 6000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore(t)
+			store.Users.Deposit("alice", 10000)
+
+			returned, err := tt.run()
+			checkError(t, err, tt.err)
+			if returned != tt.returned {
+				t.Errorf("returned %s, want %s", returned, tt.returned)
+			}
+			if got := balanceOf(t, "alice"); got != tt.balance {
+				t.Errorf("balance = %s, want %s", got, tt.balance)
+			}
+			if got, err := store.Reservations.TotalFunds("alice"); err != nil || got != tt.reserved {
+				t.Errorf("reserved = %s, %v; want %s", got, err, tt.reserved)
+			}
+		})
+	}
+}
+
+func TestSharesLedger(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      func() (int, error)
+		err      error
+		returned int // what the call returns
+		shares   int
+		reserved int
+	}{
+		{
+			name:     "reserve removes the shares",
+			run:      func() (int, error) { return 0, ReserveShares("alice", "r1", "ABC", 4) },
+			shares:   6,
+			reserved: 4,
+		},
+		{
+			name:   "reserve needs the shares",
+			run:    func() (int, error) { return 0, ReserveShares("alice", "r1", "ABC", 11) },
+			err:    errInsufficientShares,
+			shares: 10,
+		},
+		{
+			name:   "reserve needs shares of that stock",
+			run:    func() (int, error) { return 0, ReserveShares("alice", "r1", "XYZ", 1) },
+			err:    errInsufficientShares,
+			shares: 10,
+		},
+		{
+			name:   "reserve rejects a negative quantity",
+			run:    func() (int, error) { return 0, ReserveShares("alice", "r1", "ABC", -1) },
+			err:    errAny,
+			shares: 10,
+		},
+		{
+			name: "release returns all of the shares",
+			run: func() (int, error) {
+				ReserveShares("alice", "r1", "ABC", 4)
+				return ReleaseShares("alice", "r1")
+			},
+			returned: 4,
+			shares:   10,
+		},
+		{
+			name: "release some keeps the rest reserved",
+			run: func() (int, error) {
+				ReserveShares("alice", "r1", "ABC", 4)
+				return ReleaseSomeShares("alice", "r1", 3)
+			},
+			returned: 3,
+			shares:   9,
+			reserved: 1,
+		},
+		{
+			name: "release some is capped at what's reserved",
+			run: func() (int, error) {
+				ReserveShares("alice", "r1", "ABC", 4)
+				return ReleaseSomeShares("alice", "r1", 7)
+			},
+			returned: 4,
+			shares:   10,
+		},
+		{
+			name: "settle sells the shares",
+			run: func() (int, error) {
+				ReserveShares("alice", "r1", "ABC", 4)
+				return SettleShares("alice", "r1")
+			},
+			returned: 4,
+			shares:   6,
+		},
+		{
+			name:   "settle needs a reservation",
+			run:    func() (int, error) { return SettleShares("alice", "r1") },
+			err:    errNoReservation,
+			shares: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore(t)
+			store.Holdings.Add("alice", "ABC", 10)
+
+			returned, err := tt.run()
+			checkError(t, err, tt.err)
+			if returned != tt.returned {
+				t.Errorf("returned %d, want %d", returned, tt.returned)
+			}
+			if got := sharesOf(t, "alice", "ABC"); got != tt.shares {
+				t.Errorf("shares = %d, want %d", got, tt.shares)
+			}
+			if got, err := heldShares("alice", "r1"); err != nil || got != tt.reserved {
+				t.Errorf("reserved = %d, %v; want %d", got, err, tt.reserved)
+			}
+		})
+	}
+}
+
+// Matches any error in checkError
+var errAny = errors.New("any error")
+
+func checkError(t *testing.T, err error, want error) {
+	t.Helper()
+	switch {
+	case want == nil && err != nil:
+		t.Errorf("returned error %v", err)
+	case want == errAny && err == nil:
+		t.Error("returned no error")
+	case want != nil && want != errAny && !errors.Is(err, want):
+		t.Errorf("returned error %v, want %v", err, want)
+	}
+}
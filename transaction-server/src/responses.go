@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	errInvalidRequest   = errors.New("invalid request")
+	errAmountTooSmall   = errors.New("amount is less than the price of a single share")
+	errAuditUnavailable = errors.New("audit server unavailable")
+)
+
+// Every command replies with this envelope. Result holds the command's payload on success, and Code
+// holds a machine readable reason on failure, e.g. "insufficient_funds".
+type commandResponse struct {
+	Status         string // "ok" or "error"
+	Code           string `json:",omitempty"`
+	Message        string `json:",omitempty"`
+	TransactionNum int
+	Result         interface{} `json:",omitempty"`
+}
+
+// Returns an error for a request that is malformed or asks for something that's never allowed
+func invalidRequest(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+// Maps an error to the HTTP status and error code it's reported with
+func errorStatus(err error) (int, string) {
+	var parseErr *QuoteParseError
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return http.StatusBadRequest, "invalid_request"
+	case errors.Is(err, errAmountTooSmall):
+		return http.StatusUnprocessableEntity, "amount_too_small"
+	case errors.Is(err, errInsufficientFunds):
+		return http.StatusConflict, "insufficient_funds"
+	case errors.Is(err, errInsufficientShares):
+		return http.StatusConflict, "insufficient_shares"
+	case errors.Is(err, errNoBuyAmount):
+		return http.StatusConflict, "no_buy_amount"
+	case errors.Is(err, errNoSellAmount):
+		return http.StatusConflict, "no_sell_amount"
+	case errors.Is(err, errDuplicateTransaction):
+		return http.StatusConflict, "duplicate_transaction"
+	case errors.Is(err, errReservationBusy):
+		return http.StatusConflict, "reservation_busy"
+	case errors.Is(err, errNoPendingOrder):
+		return http.StatusNotFound, "no_pending_order"
+	case errors.Is(err, errNoReservation):
+		return http.StatusNotFound, "no_reservation"
+	case errors.Is(err, errNoUser):
+		return http.StatusNotFound, "no_user"
+	case errors.Is(err, errOrderExpired):
+		return http.StatusGone, "order_expired"
+	case errors.Is(err, errIdempotencyUnavailable):
+		return http.StatusServiceUnavailable, "idempotency_unavailable"
+	case errors.Is(err, errUserLockUnavailable):
+		return http.StatusServiceUnavailable, "user_lock_unavailable"
+	case errors.Is(err, errAuditUnavailable):
+		return http.StatusBadGateway, "audit_unavailable"
+	case errors.Is(err, errQuoteTimeout):
+		return http.StatusGatewayTimeout, "quote_timeout"
+	case errors.Is(err, errQuoteUnavailable), errors.Is(err, errQuoteTooLong),
+		errors.Is(err, errQuoteLockTimeout), errors.As(err, &parseErr):
+		return http.StatusBadGateway, "quote_unavailable"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+func writeResponse(w http.ResponseWriter, status int, res commandResponse) {
+	payload, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
+// Replies that the command succeeded
+// Parameters:
+// 		transactionNum:	the transaction number of the command
+// 		result:			the command's payload, or nil if it has none
+//
+func writeResult(w http.ResponseWriter, transactionNum int, result interface{}) {
+	writeResponse(w, http.StatusOK, commandResponse{"ok", "", "", transactionNum, result})
+}
+
+// Reports the error to the audit log and replies with the status and code it maps to
+// Parameters:
+// 		r:		the command's request
+// 		cmd:	the command that failed
+// 		err:	the reason the command failed
+// 		msg:	what the command was doing when it failed
+//
+func writeError(w http.ResponseWriter, r *http.Request, cmd commandInfo, err error, msg string) {
+	reportError(r.Context(), cmd, err, msg)
+
+	status, code := errorStatus(err)
+	message := msg + ": " + err.Error()
+	if status == http.StatusInternalServerError {
+		// Don't hand database or Redis errors to clients
+		message = msg
+	}
+	writeResponse(w, status, commandResponse{"error", code, message, cmd.TransactionNum, nil})
+}
@@ -2,133 +2,127 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
-	"strings"
-	"sync"
 
+	"github.com/LeeZeitz/DayTradingSystem/shared/health"
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/metrics"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/LeeZeitz/DayTradingSystem/shared/shutdown"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
 	"github.com/go-redis/redis"
-	_ "github.com/herenow/go-crate"
 )
 
+// Set up from the config by connect
 var (
-	dbstring = func() string {
-		if runningInDocker() {
-			return "http://transaction-db:4200"
-		}
-		return "http://localhost:4200"
-	}()
+	store         *Store
+	auditServer   string
+	cache         *redis.Client
+	quoteProvider QuoteProvider
+	audits        *auditClient
+)
 
-	db = loadDb()
+// Creates the store, clients and trigger engine the config describes. Nothing is contacted until it's used.
+func connect() {
+	store = loadStore()
 
-	auditServer = func() string {
-		if runningInDocker() {
-			return "http://audit:8081"
-		}
-		return "http://localhost:8081"
-	}()
-
-	redishost = func() string {
-		if runningInDocker() {
-			return "redis:6379"
-		}
-		return "http://localhost:6379"
-	}()
+	auditServer = cfg.AuditURL
 
 	cache = redis.NewClient(&redis.Options{
-		Addr:     redishost,
+		Addr:     cfg.RedisAddr,
 		Password: "",
 		DB:       0,
 	})
-)
 
-func logSystemEvent(transactionNum int, server string, command string, username string, stock string, filename string, funds float64) {
-	req := struct {
+	quoteProvider = loadQuoteProvider()
+
+	audits = newAuditClient(cfg.AuditURL, cfg.AuditQueueSize, cfg.AuditWorkers, cfg.AuditBatchSize,
+		cfg.AuditBatchInterval, cfg.AuditEnqueueTimeout, cfg.AuditSpoolFile)
+
+	triggers = newTriggerEngine(cfg.TriggerInterval)
+}
+
+// Sends a request to the audit server as part of the trace of the command it's for
+func postAudit(ctx context.Context, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, auditServer+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return tracing.Client.Do(req.WithContext(ctx))
+}
+
+func logSystemEvent(ctx context.Context, transactionNum int, server string, command string, username string, stock string, filename string, funds money.Money) {
+	audits.send(ctx, "systemEvent", transactionNum, struct {
 		TransactionNum int
 		Server         string
 		Command        string
 		Username       string
 		Stock          string
 		Filename       string
-		Funds          float64
-	}{transactionNum, server, command, username, stock, "", funds}
-
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r, err := http.Post(auditServer+"/logSystemEvent", "application/json; charset=utf-8", b)
-	if err != nil {
-
-		failGracefully(err, "Failed to log system event")
-	}
-	defer r.Body.Close()
+		Funds          money.Money
+		Timestamp      int64
+	}{transactionNum, server, command, username, stock, "", funds, createTimestamp()})
 }
 
-func logUserCommand(transactionNum int, server string, command string, username string, stock string, filename string, funds float64) {
-	req := struct {
+func logUserCommand(ctx context.Context, transactionNum int, server string, command string, username string, stock string, filename string, funds money.Money) {
+	logging.ForCommand(ctx, username, transactionNum, command).Debug("Received command", "symbol", stock, "funds", funds)
+
+	audits.send(ctx, "userCommand", transactionNum, struct {
 		TransactionNum int
 		Server         string
 		Command        string
 		Username       string
 		Stock          string
 		Filename       string
-		Funds          float64
-	}{transactionNum, server, command, username, stock, "", funds}
-
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r, err := http.Post(auditServer+"/logUserCommand", "application/json; charset=utf-8", b)
-
-	for err != nil {
-
-		r, err = http.Post(auditServer+"/logUserCommand", "application/json; charset=utf-8", b)
-
-		failGracefully(err, "Failed to log user command")
-	}
-	defer r.Body.Close()
+		Funds          money.Money
+		Timestamp      int64
+	}{transactionNum, server, command, username, stock, "", funds, createTimestamp()})
 }
 
-func logAccountTransaction(transactionNum int, server string, action string, username string, funds float64) {
-	req := struct {
+func logAccountTransaction(ctx context.Context, transactionNum int, server string, action string, username string, funds money.Money) {
+	audits.send(ctx, "accountTransaction", transactionNum, struct {
 		TransactionNum int
 		Server         string
 		Action         string
 		Username       string
-		Funds          float64
-	}{transactionNum, server, action, username, funds}
-
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r, err := http.Post(auditServer+"/logAccountTransaction", "application/json; charset=utf-8", b)
-	if err != nil {
-
-		failGracefully(err, "Failed to log account transaction")
-	}
-
-	defer r.Body.Close()
+		Funds          money.Money
+		Timestamp      int64
+	}{transactionNum, server, action, username, funds, createTimestamp()})
 }
 
-func logQuoteServer(transactionNum int, server string, username string, stock string, cryptoKey string, quoteServerTime int64, price float64) {
-	req := struct {
+func logQuoteServer(ctx context.Context, transactionNum int, server string, username string, stock string, cryptoKey string, quoteServerTime int64, price money.Money) {
+	audits.send(ctx, "quoteServer", transactionNum, struct {
 		TransactionNum  int
 		Server          string
 		Username        string
 		Stock           string
 		CryptoKey       string
 		QuoteServerTime int64
-		Price           float64
-	}{transactionNum, server, username, stock, cryptoKey, quoteServerTime, price}
-
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r, err := http.Post(auditServer+"/logQuoteServer", "application/json; charset=utf-8", b)
-	if err != nil {
-
-		failGracefully(err, "Failed to log quote server event")
-	}
+		Price           money.Money
+		Timestamp       int64
+	}{transactionNum, server, username, stock, cryptoKey, quoteServerTime, price, createTimestamp()})
+}
 
-	defer r.Body.Close()
+func logErrorEvent(ctx context.Context, transactionNum int, server string, command string, username string, stock string, filename string, funds money.Money, errorMessage string) {
+	audits.send(ctx, "errorEvent", transactionNum, struct {
+		TransactionNum int
+		Server         string
+		Command        string
+		Username       string
+		Stock          string
+		Filename       string
+		ErrorMessage   string
+		Funds          money.Money
+		Timestamp      int64
+	}{transactionNum, server, command, username, stock, filename, errorMessage, funds, createTimestamp()})
 }
 
 // Tested
@@ -137,48 +131,36 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 
 	req := struct {
 		UserID         string
-		Amount         float64
+		Amount         money.Money
 		TransactionNum int
-	}{"", 0.0, 0}
+	}{"", 0, 0}
 
 	// Read request json into struct
 	err := decoder.Decode(&req)
 	if err != nil {
-
-		failGracefully(err, "Failed to get add request")
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "ADD", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
 	}
 
-	logUserCommand(req.TransactionNum, "transaction-server", "ADD", req.UserID, "", "", req.Amount)
+	cmd := commandInfo{req.TransactionNum, "ADD", req.UserID, "", req.Amount}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "ADD", req.UserID, "", "", req.Amount)
 
 	if req.Amount < 0 {
-		fmt.Println("Can't add a negative balance")
+		writeError(w, r, cmd, invalidRequest("can't add a negative amount"), "Failed to add funds")
 		return
 	}
 
-	logAccountTransaction(req.TransactionNum, "transaction-server", "add", req.UserID, req.Amount)
-
-	// Insert new user if they don't already exist, otherwise update their balance
-	queryString := "INSERT INTO users (user_id, balance) VALUES ($1, $2)" +
-		"ON CONFLICT (user_id) DO UPDATE SET balance = balance + $2"
-
-	stmt, err := db.Prepare(queryString)
-	if err != nil {
-
-		failGracefully(err, "Failed to prep query")
-	}
-
-	res, err := stmt.Exec(req.UserID, req.Amount)
+	// Creates the user if they don't already exist, otherwise updates their balance
+	err = store.Users.Deposit(req.UserID, req.Amount)
 	if err != nil {
-
-		failGracefully(err, "Failed to do something with query")
+		writeError(w, r, cmd, err, "Failed to add funds")
+		return
 	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "add", req.UserID, req.Amount)
 
-	// Check the query actually did something (because this one should always modify something, unless add 0..?)
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failOnError(err, "Failed to add balance")
-	}
-	w.WriteHeader(http.StatusOK)
+	writeResult(w, req.TransactionNum, struct {
+		Amount money.Money
+	}{req.Amount})
 }
 
 // Tested
@@ -193,14 +175,26 @@ func quoteHandler(w http.ResponseWriter, r *http.Request) {
 	}{"", "", 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-	logUserCommand(req.TransactionNum, "transaction-server", "QUOTE", req.UserID, req.Symbol, "", 0.0)
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "QUOTE", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+	cmd := commandInfo{req.TransactionNum, "QUOTE", req.UserID, req.Symbol, 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "QUOTE", req.UserID, req.Symbol, "", 0)
 
 	// Get quote for the requested stock symbol
-	quote := getQuote(req.Symbol, req.TransactionNum, req.UserID)
+	quote, quoteTime, err := getQuote(r.Context(), req.Symbol, req.TransactionNum, req.UserID)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to get quote")
+		return
+	}
 
-	// Return UserID, Symbol, and stock quote in comma-delimited string
-	w.Write([]byte(req.UserID + "," + req.Symbol + "," + strconv.FormatFloat(quote, 'f', -1, 64)))
+	writeResult(w, req.TransactionNum, struct {
+		UserID    string
+		Symbol    string
+		Price     money.Money
+		QuoteTime int64 // time (unix ms) the quote was retrieved
+	}{req.UserID, req.Symbol, quote, quoteTime})
 }
 
 // Tested
@@ -209,60 +203,58 @@ func buyHandler(w http.ResponseWriter, r *http.Request) {
 
 	req := struct {
 		UserID         string
-		Amount         float64 // dolar amount of a stock to buy
+		Amount         money.Money // dolar amount of a stock to buy
 		Symbol         string
 		TransactionNum int
-	}{"", 0.0, "", 0}
+	}{"", 0, "", 0}
 
 	// Read request json data into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "BUY", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	logUserCommand(req.TransactionNum, "transaction-server", "BUY", req.UserID, req.Symbol, "", req.Amount)
+	cmd := commandInfo{req.TransactionNum, "BUY", req.UserID, req.Symbol, req.Amount}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "BUY", req.UserID, req.Symbol, "", req.Amount)
 
 	if req.Amount < 0 {
-		panic("Can't purchase a negative amount")
+		writeError(w, r, cmd, invalidRequest("can't purchase a negative amount"), "Failed to buy")
+		return
 	}
 
 	// Get price of requested stock
-	price := getQuote(req.Symbol, req.TransactionNum, req.UserID)
+	price, quoteTime, err := getQuote(r.Context(), req.Symbol, req.TransactionNum, req.UserID)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to get quote")
+		return
+	}
 	// Calculate total cost to buy given amount of given stock
-	buyNumber := int(req.Amount / price)
-	cost := float64(buyNumber) * price
-
-	// Query to get the current balance of the user
-	queryString := "SELECT balance FROM users WHERE user_id = $1;"
-	// Try to prepare query
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
-
-	var balance float64
-
-	// Try to perform the query and get the user's balance
-	// TODO: this should probably handle a user buy when the user doesn't exist, but it doesn't right now.
-	err = stmt.QueryRow(req.UserID).Scan(&balance)
-	failOnError(err, "Failed to get user balance")
-	defer stmt.Close()
-
-	// Check user balance against cost of requested stock purchase
-	if balance >= cost {
-		// User has enough, reserve the funds by pulling them from the account
-		queryString = "UPDATE users SET balance = balance - $1 WHERE user_id = $2"
-		stmt, err := db.Prepare(queryString)
-		failOnError(err, "Failed to prepare withdraw query")
-
-		// Withdraw funds from user's account
-		res, err := stmt.Exec(cost, req.UserID)
-		failOnError(err, "Failed to withdraw money from user account")
-
-		numrows, err := res.RowsAffected()
-		if numrows < 1 {
-			failOnError(err, "Failed to reserve funds")
-		}
-		// Add buy transaction to front of user's transaction list
-		cache.LPush(req.UserID+":buy", req.Symbol+":"+strconv.Itoa(buyNumber))
+	buyNumber := req.Amount.Shares(price)
+	cost := price.Mul(buyNumber)
+	if buyNumber == 0 {
+		writeError(w, r, cmd, errAmountTooSmall, "Failed to buy")
+		return
+	}
+
+	// Reserve the funds for the purchase. This fails if the user's balance doesn't cover the cost
+	reservationID := newReservationID(req.UserID, "buy", req.TransactionNum)
+	err = ReserveFunds(req.UserID, reservationID, cost)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to reserve funds")
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "reserve", req.UserID, cost)
+
+	// Add buy transaction to front of user's transaction list
+	order := pendingOrder{req.UserID, "buy", req.Symbol, buyNumber, price, cost, reservationID, quoteTime, req.TransactionNum}
+	err = pushPendingOrder(order)
+	if err != nil {
+		ReleaseFunds(req.UserID, reservationID)
+		writeError(w, r, cmd, err, "Failed to store buy order")
+		return
+	}
+	writeResult(w, req.TransactionNum, order)
 }
 
 // Tested
@@ -276,42 +268,56 @@ func commitBuyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request parameters into struct (just user_id)
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "COMMIT_BUY", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+
+	cmd := commandInfo{req.TransactionNum, "COMMIT_BUY", req.UserID, "", 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "COMMIT_BUY", req.UserID, "", "", 0)
 
-	logUserCommand(req.TransactionNum, "transaction-server", "COMMIT_BUY", req.UserID, "", "", 0.0)
+	// Get most recent buy transaction. Orders older than 60 seconds can't be committed
+	order, err := popPendingOrder(r.Context(), req.UserID, "buy")
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to commit buy transaction")
+		return
+	}
 
-	// Get most recent buy transaction
-	task := cache.LPop(req.UserID + ":buy")
-	tasks := strings.Split(task.Val(), ":")
+	// Spend the funds reserved for the order
+	cost, err := SettleFunds(req.UserID, order.ReservationID)
+	if err != nil {
+		restorePendingOrder(r.Context(), order, err)
+		writeError(w, r, cmd, err, "Failed to commit buy transaction")
+		return
+	}
 
-	// Check if there are any buy transactions to perform
-	if len(tasks) <= 1 {
-		w.Write([]byte("Failed to commit buy transaction: no buy orders exist"))
+	// Add new stocks to user's account. If they can't be added, the user gets their money back
+	err = buyStock(r.Context(), req.UserID, order.Symbol, order.Quantity, cost, req.TransactionNum)
+	if err != nil {
+		refundFunds(req.UserID, cost)
+		writeError(w, r, cmd, err, "Failed to add stocks to account")
 		return
 	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "remove", req.UserID, cost)
 
-	// Add new stocks to user's account
-	buyStock(req.UserID, tasks[0], tasks[1], req.TransactionNum)
-	w.WriteHeader(http.StatusOK)
+	writeResult(w, req.TransactionNum, struct {
+		Symbol   string
+		Quantity int
+		Amount   money.Money
+	}{order.Symbol, order.Quantity, cost})
 }
 
-func buyStock(UserID string, Symbol string, quantity string, transactionNum int) {
+// Adds bought shares to a user's account, and logs what they cost
+func buyStock(ctx context.Context, UserID string, Symbol string, quantity int, cost money.Money, transactionNum int) error {
 	// Add new stocks to user's account
-	queryString := "INSERT INTO stocks (quantity, symbol, user_id) VALUES ($1, $2, $3) " +
-		"ON CONFLICT (user_id, symbol) DO UPDATE SET quantity = quantity + $1;"
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
-	res, err := stmt.Exec(quantity, Symbol, UserID)
-	failGracefully(err, "Failed to add stocks to account")
-
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
+	err := store.Holdings.Add(UserID, Symbol, quantity)
+	if err != nil {
 		failGracefully(err, "Failed to add stocks to account")
+		return err
 	}
 
-	f, err := strconv.ParseFloat(quantity, 64)
-	failOnError(err, "Failed to parse float")
-	logAccountTransaction(transactionNum, "transaction-server", "BUY", UserID, f) // todo add transnum
+	logAccountTransaction(ctx, transactionNum, "transaction-server", "BUY", UserID, cost)
+	return nil
 }
 
 // Tested
@@ -324,12 +330,34 @@ func cancelBuyHandler(w http.ResponseWriter, r *http.Request) {
 	}{"", 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "CANCEL_BUY", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+
+	cmd := commandInfo{req.TransactionNum, "CANCEL_BUY", req.UserID, "", 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "CANCEL_BUY", req.UserID, "", "", 0)
+
+	// An expired order has already been refunded, so there is nothing left to cancel
+	order, err := popPendingOrder(r.Context(), req.UserID, "buy")
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to cancel buy transaction")
+		return
+	}
 
-	cache.LPop(req.UserID + ":buy")
+	// Give the user back the money reserved for the order
+	refund, err := ReleaseFunds(req.UserID, order.ReservationID)
+	if err != nil {
+		restorePendingOrder(r.Context(), order, err)
+		writeError(w, r, cmd, err, "Failed to cancel buy transaction")
+		return
+	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "release", req.UserID, refund)
 
-	logUserCommand(req.TransactionNum, "transaction-server", "CANCEL_BUY", req.UserID, "", "", 0.0)
-	w.WriteHeader(http.StatusOK)
+	writeResult(w, req.TransactionNum, struct {
+		Symbol string
+		Amount money.Money
+	}{order.Symbol, refund})
 }
 
 // Tested
@@ -338,57 +366,55 @@ func sellHandler(w http.ResponseWriter, r *http.Request) {
 
 	req := struct {
 		UserID         string
-		Amount         float64 // Dollar value to sell
+		Amount         money.Money // Dollar value to sell
 		Symbol         string
 		TransactionNum int
-	}{"", 0.0, "", 0}
+	}{"", 0, "", 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-	logUserCommand(req.TransactionNum, "transaction-server", "SELL", req.UserID, req.Symbol, "", req.Amount)
-
-	price := getQuote(req.Symbol, req.TransactionNum, req.UserID)
-
-	// Calculate the number of the stock to sell
-	sellNumber := int(req.Amount / price)
-	salePrice := price * float64(sellNumber)
-
-	// TODO: Should handle an attempted sale of unowned stocks
-	// Check that the user has enough stocks to sell
-	queryString := "SELECT quantity FROM stocks WHERE user_id = $1 and symbol = $2"
-
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "SELL", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+	cmd := commandInfo{req.TransactionNum, "SELL", req.UserID, req.Symbol, req.Amount}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "SELL", req.UserID, req.Symbol, "", req.Amount)
 
-	// Number of given stock owned by user
-	var balance int
-	err = stmt.QueryRow(req.UserID, req.Symbol).Scan(&balance)
-	defer stmt.Close()
+	if req.Amount < 0 {
+		writeError(w, r, cmd, invalidRequest("can't sell a negative amount"), "Failed to sell")
+		return
+	}
 
+	price, quoteTime, err := getQuote(r.Context(), req.Symbol, req.TransactionNum, req.UserID)
 	if err != nil {
-		//fmt.Println("Failed to retrieve number of given stock owned by user")
-		w.Write([]byte("Failed to retrieve number of given stock owned by user"))
+		writeError(w, r, cmd, err, "Failed to get quote")
 		return
 	}
 
-	// Check if the user has enough
-	if balance >= sellNumber {
-		queryString = "UPDATE stocks SET quantity = quantity - $1 where user_id = $2 and symbol = $3;"
-		stmt, err = db.Prepare(queryString)
-		failOnError(err, "Failed to prepare query")
+	// Calculate the number of the stock to sell
+	sellNumber := req.Amount.Shares(price)
+	salePrice := price.Mul(sellNumber)
+	if sellNumber == 0 {
+		writeError(w, r, cmd, errAmountTooSmall, "Failed to sell")
+		return
+	}
 
-		// Withdraw the stocks to sell from user's account
-		res, err := stmt.Exec(sellNumber, req.UserID, req.Symbol)
-		failOnError(err, "Failed to reserve stocks to sell")
+	// Reserve the stocks to sell. This fails if the user doesn't own enough of them
+	reservationID := newReservationID(req.UserID, "sell", req.TransactionNum)
+	err = ReserveShares(req.UserID, reservationID, req.Symbol, sellNumber)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to reserve stocks to sell")
+		return
+	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "reserve", req.UserID, salePrice)
 
-		numrows, err := res.RowsAffected()
-		if numrows < 1 {
-			failOnError(err, "Failed to reserve stocks to sell")
-		}
-		fmt.Println(salePrice)
-		cache.LPush(req.UserID+":sell", req.Symbol+":"+strconv.FormatFloat(salePrice, 'f', -1, 64))
+	order := pendingOrder{req.UserID, "sell", req.Symbol, sellNumber, price, salePrice, reservationID, quoteTime, req.TransactionNum}
+	err = pushPendingOrder(order)
+	if err != nil {
+		ReleaseShares(req.UserID, reservationID)
+		writeError(w, r, cmd, err, "Failed to store sell order")
+		return
 	}
-	w.WriteHeader(http.StatusOK)
+	writeResult(w, req.TransactionNum, order)
 }
 
 // Tested
@@ -401,52 +427,43 @@ func commitSellHandler(w http.ResponseWriter, r *http.Request) {
 	}{"", 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-
-	logUserCommand(req.TransactionNum, "transaction-server", "COMMIT_SELL", req.UserID, "", "", 0.0)
-
-	task := cache.LPop(req.UserID + ":sell")
-	tasks := strings.Split(task.Val(), ":")
-
-	if len(tasks) <= 1 {
-		w.Write([]byte("Failed to commit sell transaction: no sell orders exist"))
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "COMMIT_SELL", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
 		return
 	}
 
-	queryString := "UPDATE users SET balance = balance + $1 WHERE user_id = $2;"
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
-	res, err := stmt.Exec(tasks[1], req.UserID)
-	failOnError(err, "Failed to refund money for stock sale")
+	cmd := commandInfo{req.TransactionNum, "COMMIT_SELL", req.UserID, "", 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "COMMIT_SELL", req.UserID, "", "", 0)
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failGracefully(err, "Failed to refund money for stock sale")
+	// Orders older than 60 seconds can't be committed
+	order, err := popPendingOrder(r.Context(), req.UserID, "sell")
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to commit sell transaction")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-
-}
-
-func sellStock(UserID string, Symbol string, quantity string, transactionNum int) {
-	f, err := strconv.ParseFloat(quantity, 64)
-	failOnError(err, "Failed to parse float")
-	logAccountTransaction(transactionNum, "transaction-server", "SELL", UserID, f)
-
-	queryString := "UPDATE stocks SET quantity = quantity - $1 where user_id = $2 and symbol = $3;"
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
 
-	// Withdraw the stocks to sell from user's account
-	res, err := stmt.Exec(quantity, UserID, Symbol)
+	// The reserved stocks are sold
+	quantity, err := SettleShares(req.UserID, order.ReservationID)
 	if err != nil {
-		fmt.Println("Failed to reserve stocks to sell")
+		restorePendingOrder(r.Context(), order, err)
+		writeError(w, r, cmd, err, "Failed to commit sell transaction")
 		return
 	}
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failGracefully(err, "Failed to reserve stocks to sell")
+
+	// If the proceeds can't be added, the user gets their stocks back
+	err = store.Users.Deposit(req.UserID, order.Amount)
+	if err != nil {
+		refundShares(req.UserID, order.Symbol, quantity)
+		writeError(w, r, cmd, err, "Failed to add money for stock sale")
+		return
 	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "add", req.UserID, order.Amount)
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol   string
+		Quantity int
+		Amount   money.Money
+	}{order.Symbol, order.Quantity, order.Amount})
 }
 
 // Tested
@@ -459,12 +476,34 @@ func cancelSellHandler(w http.ResponseWriter, r *http.Request) {
 	}{"", 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "CANCEL_SELL", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	logUserCommand(req.TransactionNum, "transaction-server", "CANCEL_SELL", req.UserID, "", "", 0.0)
+	cmd := commandInfo{req.TransactionNum, "CANCEL_SELL", req.UserID, "", 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "CANCEL_SELL", req.UserID, "", "", 0)
 
-	cache.LPop(req.UserID + ":sell")
-	w.WriteHeader(http.StatusOK)
+	// An expired order has already been released, so there is nothing left to cancel
+	order, err := popPendingOrder(r.Context(), req.UserID, "sell")
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to cancel sell transaction")
+		return
+	}
+
+	// Give the user back the stocks reserved for the order
+	quantity, err := ReleaseShares(req.UserID, order.ReservationID)
+	if err != nil {
+		restorePendingOrder(r.Context(), order, err)
+		writeError(w, r, cmd, err, "Failed to cancel sell transaction")
+		return
+	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "release", req.UserID, order.Price.Mul(quantity))
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol   string
+		Quantity int
+	}{order.Symbol, quantity})
 }
 
 // Tested
@@ -472,37 +511,51 @@ func setBuyAmountHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	req := struct {
-		UserID         string  // id of the user buying
-		Symbol         string  // symbol of the stock to buy
-		Amount         float64 // dollar amount of stock to buy
+		UserID         string      // id of the user buying
+		Symbol         string      // symbol of the stock to buy
+		Amount         money.Money // dollar amount of stock to buy
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	// Parse request into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-
-	logUserCommand(req.TransactionNum, "transaction-server", "SET_BUY_AMOUNT", req.UserID, req.Symbol, "", req.Amount)
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "SET_BUY_AMOUNT", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	// Add buy amount to user's account. If a buy amount already exists for the requested stock, add this to it
-	queryString := "INSERT INTO buy_amounts (user_id, symbol, quantity) VALUES ($1, $2, $3) " +
-		"ON CONFLICT (user_id, symbol) DO UPDATE SET quantity = quantity + $3;"
+	cmd := commandInfo{req.TransactionNum, "SET_BUY_AMOUNT", req.UserID, req.Symbol, req.Amount}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "SET_BUY_AMOUNT", req.UserID, req.Symbol, "", req.Amount)
 
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
-	res, err := stmt.Exec(req.UserID, req.Symbol, req.Amount)
+	if req.Amount < 0 {
+		writeError(w, r, cmd, invalidRequest("can't set a negative buy amount"), "Failed to set buy amount")
+		return
+	}
 
+	// Hold the money for the buy amount until the trigger fires or is cancelled
+	err = ReserveFunds(req.UserID, buyAmountReservationID(req.UserID, req.Symbol), req.Amount)
 	if err != nil {
-		failGracefully(err, "Failed to update buy amount")
+		writeError(w, r, cmd, err, "Failed to reserve funds for buy amount")
 		return
 	}
+	logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "reserve", req.UserID, req.Amount)
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failGracefully(err, "Failed to update buy amount")
+	// Add buy amount to user's account. If a buy amount already exists for the requested stock, add this to it
+	err = store.BuyAmounts.Add(req.UserID, req.Symbol, req.Amount)
+	if err != nil {
+		// Nothing refers to the money just reserved, so give it back. Earlier buy amounts keep theirs
+		refund, releaseErr := ReleaseSomeFunds(req.UserID, buyAmountReservationID(req.UserID, req.Symbol), req.Amount)
+		if releaseErr == nil {
+			logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "release", req.UserID, refund)
+		}
+		writeError(w, r, cmd, err, "Failed to update buy amount")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol string
+		Amount money.Money
+	}{req.Symbol, req.Amount})
 }
 
 // Tested
@@ -517,70 +570,91 @@ func cancelSetBuyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-
-	logUserCommand(req.TransactionNum, "transaction-server", "CANCEL_SET_BUY", req.UserID, req.Symbol, "", 0.0)
-
-	queryString1 := "DELETE FROM buy_amounts WHERE user_id = $1 AND symbol = $2;"
-	queryString2 := "DELETE FROM triggers WHERE user_id = $1 AND symbol = $2 AND method = 'buy';"
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "CANCEL_SET_BUY", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	rows1, err := db.Query(queryString1, req.UserID, req.Symbol)
-	defer rows1.Close()
+	cmd := commandInfo{req.TransactionNum, "CANCEL_SET_BUY", req.UserID, req.Symbol, 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "CANCEL_SET_BUY", req.UserID, req.Symbol, "", 0)
 
+	err = store.BuyAmounts.Delete(req.UserID, req.Symbol)
 	if err != nil {
-		fmt.Println("Failed to delete buy amount")
-		w.Write([]byte("Failed to delete buy amount"))
+		writeError(w, r, cmd, err, "Failed to delete buy amount")
 		return
 	}
 
-	rows2, err := db.Query(queryString2, req.UserID, req.Symbol)
-	defer rows2.Close()
+	err = store.Triggers.Delete(req.UserID, req.Symbol, "buy")
 	if err != nil {
-		w.Write([]byte("Failed to delete trigger"))
+		writeError(w, r, cmd, err, "Failed to delete buy trigger")
 		return
 	}
+	triggers.remove(req.UserID, req.Symbol, "buy")
+
+	// Give the user back the money held for the buy amount
+	refund, err := ReleaseFunds(req.UserID, buyAmountReservationID(req.UserID, req.Symbol))
+	if err != nil && err != errNoReservation {
+		writeError(w, r, cmd, err, "Failed to release reserved funds")
+		return
+	}
+	if err == nil {
+		logAccountTransaction(r.Context(), req.TransactionNum, "transaction-server", "release", req.UserID, refund)
+	}
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol string
+		Amount money.Money
+	}{req.Symbol, refund})
 }
 
-// TODO: Every 60 seconds, see if price is cached. If it is, check it against triggers. If it's not and there's a trigger
-// that exists, get quote for that stock and evaluate trigger.
 func setBuyTriggerHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
 	req := struct {
 		UserID         string
 		Symbol         string
-		Price          float64
+		Price          money.Money
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-
-	logUserCommand(req.TransactionNum, "transaction-server", "SET_BUY_TRIGGER", req.UserID, req.Symbol, "", req.Price)
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "SET_BUY_TRIGGER", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	queryString := "INSERT INTO triggers (user_id, symbol, price, method, transaction_num) VALUES ($1, $2, $3, 'buy', $4) " +
-		"ON CONFLICT (user_id, symbol, method) DO UPDATE SET price = $3;"
+	cmd := commandInfo{req.TransactionNum, "SET_BUY_TRIGGER", req.UserID, req.Symbol, req.Price}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "SET_BUY_TRIGGER", req.UserID, req.Symbol, "", req.Price)
 
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query statement")
+	if req.Price <= 0 {
+		writeError(w, r, cmd, invalidRequest("trigger price must be positive"), "Failed to add buy trigger")
+		return
+	}
 
-	res, err := stmt.Exec(req.UserID, req.Symbol, req.Price, req.TransactionNum)
+	// The trigger spends the buy amount when it fires, so there has to be one that can pay for a share
+	amount, err := store.BuyAmounts.Get(req.UserID, req.Symbol)
+	if err == errNoAmount {
+		err = errNoBuyAmount
+	}
+	if err == nil && amount.Shares(req.Price) == 0 {
+		err = fmt.Errorf("%w: buy amount of %s at %s", errAmountTooSmall, amount, req.Price)
+	}
 	if err != nil {
-		failGracefully(err, "Failed to add trigger")
-		w.Write([]byte("Failed to add trigger"))
+		writeError(w, r, cmd, err, "Failed to add buy trigger")
 		return
 	}
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failGracefully(err, "Failed to add trigger")
-		w.Write([]byte("Failed to add trigger"))
+	err = store.Triggers.Set(activeTrigger{req.UserID, req.Symbol, "buy", req.Price, req.TransactionNum})
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to add buy trigger")
 		return
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go monitorTrigger(req.UserID, req.Symbol, "buy")
-	w.WriteHeader(http.StatusOK)
+	triggers.add(req.UserID, req.Symbol, "buy", req.Price, req.TransactionNum)
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol string
+		Price  money.Money
+	}{req.Symbol, req.Price})
 }
 
 // Tested
@@ -590,36 +664,37 @@ func setSellAmountHandler(w http.ResponseWriter, r *http.Request) {
 	req := struct {
 		UserID         string
 		Symbol         string
-		Amount         float64 // dollar amount of stock to sell
+		Amount         money.Money // dollar amount of stock to sell
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	// Parse request into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-
-	logUserCommand(req.TransactionNum, "transaction-server", "SET_SELL_AMOUNT", req.UserID, req.Symbol, "", req.Amount)
-
-	// Add buy amount to user's account. If a buy amount already exists for the requested stock, add this to it
-	queryString := "INSERT INTO sell_amounts (user_id, symbol, quantity) VALUES ($1, $2, $3) " +
-		"ON CONFLICT (user_id, symbol) DO UPDATE SET quantity = quantity + $3;"
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "SET_SELL_AMOUNT", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query")
+	cmd := commandInfo{req.TransactionNum, "SET_SELL_AMOUNT", req.UserID, req.Symbol, req.Amount}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "SET_SELL_AMOUNT", req.UserID, req.Symbol, "", req.Amount)
 
-	res, err := stmt.Exec(req.UserID, req.Symbol, req.Amount)
-	if err != nil {
-		failGracefully(err, "Failed to update sell amount")
-		w.Write([]byte("Failed to add trigger"))
+	if req.Amount < 0 {
+		writeError(w, r, cmd, invalidRequest("can't set a negative sell amount"), "Failed to set sell amount")
+		return
 	}
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failGracefully(err, "Failed to update sell amount")
-		w.Write([]byte("Failed to update sell amount"))
+	// Add sell amount to user's account. If a sell amount already exists for the requested stock, add this to it
+	// The shares to sell are reserved once SET_SELL_TRIGGER gives the price to sell them at
+	err = store.SellAmounts.Add(req.UserID, req.Symbol, req.Amount)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to update sell amount")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol string
+		Amount money.Money
+	}{req.Symbol, req.Amount})
 }
 
 // Tested
@@ -629,39 +704,44 @@ func setSellTriggerHandler(w http.ResponseWriter, r *http.Request) {
 	req := struct {
 		UserID         string
 		Symbol         string
-		Price          float64
+		Price          money.Money
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-
-	logUserCommand(req.TransactionNum, "transaction-server", "SET_SELL_TRIGGER", req.UserID, req.Symbol, "", req.Price)
-
-	queryString := "INSERT INTO triggers (user_id, symbol, price, method, transaction_num) VALUES ($1, $2, $3, 'sell', $4) " +
-		"ON CONFLICT (user_id, symbol, method) DO UPDATE SET price = $3;"
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "SET_SELL_TRIGGER", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
-	stmt, err := db.Prepare(queryString)
-	failOnError(err, "Failed to prepare query statement")
+	cmd := commandInfo{req.TransactionNum, "SET_SELL_TRIGGER", req.UserID, req.Symbol, req.Price}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "SET_SELL_TRIGGER", req.UserID, req.Symbol, "", req.Price)
 
-	res, err := stmt.Exec(req.UserID, req.Symbol, req.Price, req.TransactionNum)
+	if req.Price <= 0 {
+		writeError(w, r, cmd, invalidRequest("trigger price must be positive"), "Failed to add sell trigger")
+		return
+	}
 
+	// Reserve the shares the sell amount is worth at the trigger price
+	reserved, err := reserveSellAmountShares(r.Context(), req.UserID, req.Symbol, req.Price, req.TransactionNum)
 	if err != nil {
-		failGracefully(err, "Failed to add sell trigger")
-		w.Write([]byte("Failed to add trigger"))
+		writeError(w, r, cmd, err, "Failed to reserve stocks for sell trigger")
 		return
 	}
 
-	numrows, err := res.RowsAffected()
-	if numrows < 1 {
-		failGracefully(err, "Failed to add sell trigger")
-		w.Write([]byte("Failed to add trigger"))
+	err = store.Triggers.Set(activeTrigger{req.UserID, req.Symbol, "sell", req.Price, req.TransactionNum})
+	if err != nil {
+		releaseSellAmountShares(r.Context(), req.UserID, req.Symbol, req.Price, req.TransactionNum)
+		writeError(w, r, cmd, err, "Failed to add sell trigger")
 		return
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go monitorTrigger(req.UserID, req.Symbol, "sell")
-	w.WriteHeader(http.StatusOK)
+	triggers.add(req.UserID, req.Symbol, "sell", req.Price, req.TransactionNum)
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol   string
+		Price    money.Money
+		Quantity int // number of shares reserved to sell
+	}{req.Symbol, req.Price, reserved})
 }
 
 // Tested
@@ -676,29 +756,42 @@ func cancelSetSellHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-	logUserCommand(req.TransactionNum, "transaction-server", "CANCEL_SET_SELL", req.UserID, req.Symbol, "", 0.0)
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "CANCEL_SET_SELL", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+	cmd := commandInfo{req.TransactionNum, "CANCEL_SET_SELL", req.UserID, req.Symbol, 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "CANCEL_SET_SELL", req.UserID, req.Symbol, "", 0)
 
-	queryString1 := "DELETE FROM sell_amounts WHERE user_id = $1 AND symbol = $2;"
-	queryString2 := "DELETE FROM triggers WHERE user_id = $1 AND symbol = $2 AND method = 'sell';"
+	// The trigger price values the reserved shares for the audit log. Without a trigger there's nothing reserved
+	t, err := store.Triggers.Get(req.UserID, req.Symbol, "sell")
+	if err != nil && err != errNoTrigger {
+		reportError(r.Context(), cmd, err, "Failed to get sell trigger")
+	}
 
-	rows1, err := db.Query(queryString1, req.UserID, req.Symbol)
+	err = store.SellAmounts.Delete(req.UserID, req.Symbol)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to delete sell amount")
+		return
+	}
 
+	err = store.Triggers.Delete(req.UserID, req.Symbol, "sell")
 	if err != nil {
-		failGracefully(err, "Failed to delete sell amount")
-		w.Write([]byte("Failed to delete sell amount"))
+		writeError(w, r, cmd, err, "Failed to delete sell trigger")
 		return
 	}
-	defer rows1.Close()
+	triggers.remove(req.UserID, req.Symbol, "sell")
 
-	rows2, err := db.Query(queryString2, req.UserID, req.Symbol)
+	// Give the user back the stocks held for the sell trigger
+	err = releaseSellAmountShares(r.Context(), req.UserID, req.Symbol, t.Price, req.TransactionNum)
 	if err != nil {
-		failGracefully(err, "Failed to delete sell trigger")
-		w.Write([]byte("Failed to delete sell trigger"))
+		writeError(w, r, cmd, err, "Failed to release reserved stocks")
 		return
 	}
-	defer rows2.Close()
-	w.WriteHeader(http.StatusOK)
+
+	writeResult(w, req.TransactionNum, struct {
+		Symbol string
+	}{req.Symbol})
 }
 
 func dumpLogHandler(w http.ResponseWriter, r *http.Request) {
@@ -712,28 +805,47 @@ func dumpLogHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "DUMPLOG", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
 
+	cmd := commandInfo{req.TransactionNum, "DUMPLOG", req.UserID, "", 0}
 	if req.UserID == "" {
-		logUserCommand(req.TransactionNum, "transaction-server", "DUMPLOG", "", "", req.Filename, 0.0)
+		logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "DUMPLOG", "", "", req.Filename, 0)
 	} else {
-		logUserCommand(req.TransactionNum, "transaction-server", "DUMPLOG", req.UserID, "", req.Filename, 0.0)
+		logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "DUMPLOG", req.UserID, "", req.Filename, 0)
+	}
+
+	// The dump should include everything logged before it, and at least the DUMPLOG command itself
+	ctx, cancel := context.WithTimeout(context.Background(), auditFlushTimeout)
+	defer cancel()
+	if !audits.flush(ctx) {
+		logging.ForCommand(r.Context(), req.UserID, req.TransactionNum, "DUMPLOG").Warn("Dumping the log before earlier audit events were sent",
+			"pending", audits.pending())
 	}
 
 	b := new(bytes.Buffer)
 	json.NewEncoder(b).Encode(req)
 
+	endpoint := "/dumpUserLog"
 	if req.UserID == "" {
-		res, err := http.Post(auditServer+"/dumpLog", "application/json; charset=utf-8", b)
-		failOnError(err, "Failed to retrieve quote from quote server")
-		w.Write([]byte("Failed to log"))
-		defer res.Body.Close()
-	} else {
-		res, err := http.Post(auditServer+"/dumpUserLog", "application/json; charset=utf-8", b)
-		failOnError(err, "Failed to retrieve quote from quote server")
-		w.Write([]byte("Failed to log"))
-		defer res.Body.Close()
+		endpoint = "/dumpLog"
+	}
+	res, err := postAudit(r.Context(), endpoint, b)
+	if err != nil {
+		writeError(w, r, cmd, fmt.Errorf("%w: %s", errAuditUnavailable, err), "Failed to dump log")
+		return
 	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		writeError(w, r, cmd, fmt.Errorf("%w: %s", errAuditUnavailable, res.Status), "Failed to dump log")
+		return
+	}
+
+	writeResult(w, req.TransactionNum, struct {
+		Filename string
+	}{req.Filename})
 }
 
 func displaySummaryHandler(w http.ResponseWriter, r *http.Request) {
@@ -746,9 +858,19 @@ func displaySummaryHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse request")
-	logUserCommand(req.TransactionNum, "transaction-server", "DISPLAY_SUMMARY", req.UserID, "", "", 0.0)
-	w.WriteHeader(http.StatusOK)
+	if err != nil {
+		writeError(w, r, commandInfo{TransactionNum: req.TransactionNum, Command: "DISPLAY_SUMMARY", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+	cmd := commandInfo{req.TransactionNum, "DISPLAY_SUMMARY", req.UserID, "", 0}
+	logUserCommand(r.Context(), req.TransactionNum, "transaction-server", "DISPLAY_SUMMARY", req.UserID, "", "", 0)
+
+	summary, err := getAccountSummary(r.Context(), req.UserID)
+	if err != nil {
+		writeError(w, r, cmd, err, "Failed to get account summary")
+		return
+	}
+	writeResult(w, req.TransactionNum, summary)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -761,60 +883,113 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}{""}
 
 	response := struct {
-		Balance float64
+		Balance money.Money
 	}{0}
 
-	_ = decoder.Decode(&req)
-
-	queryString := "SELECT balance FROM users WHERE user_id = $1;"
-
-	stmt, _ := db.Prepare(queryString)
-
-	err := stmt.QueryRow(req.UserID).Scan(&response.Balance)
-	defer stmt.Close()
-
-	// If query returns nothing, we need to add the user to the database with a balance of 0
+	err := decoder.Decode(&req)
 	if err != nil {
-		queryString = "INSERT INTO users (user_id, balance) VALUES ($1, $2)"
-
-		stmt, _ := db.Prepare(queryString)
+		writeError(w, r, commandInfo{Command: "LOGIN", UserID: req.UserID}, invalidRequest("%s", err), "Failed to parse request")
+		return
+	}
+	cmd := commandInfo{0, "LOGIN", req.UserID, "", 0}
+	if req.UserID == "" {
+		writeError(w, r, cmd, invalidRequest("missing UserID"), "Failed to log in")
+		return
+	}
 
-		res, _ := stmt.Exec(req.UserID, 0)
+	response.Balance, err = store.Users.Balance(req.UserID)
 
-		numrows, err := res.RowsAffected()
-		if numrows < 1 {
-			failOnError(err, "Failed to add balance")
+	// If the user doesn't exist, we need to add them with a balance of 0
+	if err == errNoUser {
+		err = store.Users.Create(req.UserID)
+		if err != nil {
+			writeError(w, r, cmd, err, "Failed to add user")
+			return
 		}
-		response.Balance = 0.0
+		response.Balance = 0
+	} else if err != nil {
+		writeError(w, r, cmd, err, "Failed to get balance")
+		return
 	}
-	payload, _ := json.Marshal(response)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(payload)
+	writeResult(w, 0, response)
 }
 
 func enableCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 }
 
+// The dependencies the server can't handle commands without
+func readinessChecks() []health.Check {
+	return []health.Check{
+		{Name: cfg.Database, Check: store.Ping},
+		{Name: "redis", Check: func(ctx context.Context) error {
+			return cache.WithContext(ctx).Ping().Err()
+		}},
+		health.HTTPCheck("audit", auditServer+"/healthz"),
+		{Name: "quotes", Check: quoteProvider.Ping},
+	}
+}
+
 func main() {
-	port := ":8080"
-	http.HandleFunc("/add", addHandler)
-	http.HandleFunc("/quote", quoteHandler)
-	http.HandleFunc("/buy", buyHandler)
-	http.HandleFunc("/commit_buy", commitBuyHandler)
-	http.HandleFunc("/cancel_buy", cancelBuyHandler)
-	http.HandleFunc("/sell", sellHandler)
-	http.HandleFunc("/commit_sell", commitSellHandler)
-	http.HandleFunc("/cancel_sell", cancelSellHandler)
-	http.HandleFunc("/set_buy_amount", setBuyAmountHandler)
-	http.HandleFunc("/cancel_set_buy", cancelSetBuyHandler)
-	http.HandleFunc("/set_buy_trigger", setBuyTriggerHandler)
-	http.HandleFunc("/set_sell_amount", setSellAmountHandler)
-	http.HandleFunc("/set_sell_trigger", setSellTriggerHandler)
-	http.HandleFunc("/cancel_set_sell", cancelSetSellHandler)
-	http.HandleFunc("/dumplog", dumpLogHandler)
-	http.HandleFunc("/display_summary", displaySummaryHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.ListenAndServe(port, nil)
+	cfg, settings = loadConfig(os.Args[1:])
+	connect()
+
+	if len(settings.Args) > 0 && settings.Args[0] == "migrate" {
+		migrateCommand(settings.Args[1:])
+		return
+	}
+	settings.Print(os.Stdout)
+	flushTraces, err := tracing.Start("transaction-server", cfg.TraceExporter, cfg.TraceTarget)
+	if err != nil {
+		slog.Error("Failed to start tracing", "error", err)
+		os.Exit(1)
+	}
+
+	port := ":" + strconv.Itoa(cfg.Port)
+	if store.Schema != nil {
+		err := store.Schema.Up()
+		if err != nil {
+			slog.Error("Failed to migrate the database", "error", err)
+			os.Exit(1)
+		}
+	}
+	audits.start()
+	sweeper := startOrderSweeper()
+	recoverTriggers()
+
+	// Every command that changes a user's account runs on that user's queue, and only once per TransactionNum
+	metrics.HandleFunc("/add", serializeByUser(idempotent(addHandler)))
+	metrics.HandleFunc("/quote", quoteHandler)
+	metrics.HandleFunc("/buy", serializeByUser(idempotent(buyHandler)))
+	metrics.HandleFunc("/commit_buy", serializeByUser(idempotent(commitBuyHandler)))
+	metrics.HandleFunc("/cancel_buy", serializeByUser(idempotent(cancelBuyHandler)))
+	metrics.HandleFunc("/sell", serializeByUser(idempotent(sellHandler)))
+	metrics.HandleFunc("/commit_sell", serializeByUser(idempotent(commitSellHandler)))
+	metrics.HandleFunc("/cancel_sell", serializeByUser(idempotent(cancelSellHandler)))
+	metrics.HandleFunc("/set_buy_amount", serializeByUser(idempotent(setBuyAmountHandler)))
+	metrics.HandleFunc("/cancel_set_buy", serializeByUser(idempotent(cancelSetBuyHandler)))
+	metrics.HandleFunc("/set_buy_trigger", serializeByUser(idempotent(setBuyTriggerHandler)))
+	metrics.HandleFunc("/set_sell_amount", serializeByUser(idempotent(setSellAmountHandler)))
+	metrics.HandleFunc("/set_sell_trigger", serializeByUser(idempotent(setSellTriggerHandler)))
+	metrics.HandleFunc("/cancel_set_sell", serializeByUser(idempotent(cancelSetSellHandler)))
+	metrics.HandleFunc("/dumplog", dumpLogHandler)
+	metrics.HandleFunc("/display_summary", serializeByUser(displaySummaryHandler))
+	metrics.HandleFunc("/login", serializeByUser(loginHandler))
+	http.HandleFunc("/healthz", health.Healthz)
+	http.HandleFunc("/readyz", health.Readyz(readinessChecks()...))
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/admin/log_level", logging.LevelHandler(cfg.AdminToken))
+
+	// Running commands finish first, then triggers that are firing, then the audit events they produced are
+	// sent or spooled, then the spans of all of them
+	server := &http.Server{Addr: port, Handler: tracing.Middleware(http.DefaultServeMux)}
+	err = shutdown.ListenAndServe(server, cfg.ShutdownTimeout,
+		triggers.stop,
+		sweeper.stop,
+		audits.stop,
+		flushTraces,
+	)
+	if err != nil {
+		slog.Error("Transaction server stopped", "error", err)
+	}
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+func amountOf(t *testing.T, amounts AmountRepository, UserID string, Symbol string) money.Money {
+	t.Helper()
+	amount, err := amounts.Get(UserID, Symbol)
+	if err != nil && err != errNoAmount {
+		t.Fatal(err)
+	}
+	return amount
+}
+
+// Sends a command straight to its handler, skipping the Redis backed idempotency and queueing
+func runCommand(t *testing.T, handler http.HandlerFunc, body string) (int, commandResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+
+	var res commandResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("reply %q isn't a command response: %v", w.Body.String(), err)
+	}
+	return w.Code, res
+}
+
+// What alice's account and ABC holdings should look like after a command
+type account struct {
+	balance     money.Money
+	shares      int
+	buyAmount   money.Money
+	sellAmount  money.Money
+	reserved    money.Money
+	sharesHeld  int
+	sellTrigger bool
+}
+
+func checkAccount(t *testing.T, want account) {
+	t.Helper()
+	if got := balanceOf(t, "alice"); got != want.balance {
+		t.Errorf("balance = %s, want %s", got, want.balance)
+	}
+	if got := sharesOf(t, "alice", "ABC"); got != want.shares {
+		t.Errorf("shares = %d, want %d", got, want.shares)
+	}
+	if got := amountOf(t, store.BuyAmounts, "alice", "ABC"); got != want.buyAmount {
+		t.Errorf("buy amount = %s, want %s", got, want.buyAmount)
+	}
+	if got := amountOf(t, store.SellAmounts, "alice", "ABC"); got != want.sellAmount {
+		t.Errorf("sell amount = %s, want %s", got, want.sellAmount)
+	}
+	if got, err := store.Reservations.TotalFunds("alice"); err != nil || got != want.reserved {
+		t.Errorf("reserved funds = %s, %v; want %s", got, err, want.reserved)
+	}
+	held, err := heldShares("alice", sellAmountReservationID("alice", "ABC"))
+	if err != nil || held != want.sharesHeld {
+		t.Errorf("reserved shares = %d, %v; want %d", held, err, want.sharesHeld)
+	}
+	_, err = store.Triggers.Get("alice", "ABC", "sell")
+	if got := err == nil; got != want.sellTrigger {
+		t.Errorf("sell trigger set = %v, want %v", got, want.sellTrigger)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func()
+		handler http.HandlerFunc
+		body    string
+		status  int
+		code    string
+		want    account
+	}{
+		{
+			name:    "add creates the account",
+			handler: addHandler,
+			body:    `{"UserID": "alice", "Amount": 12.34, "TransactionNum": 1}`,
+			status:  http.StatusOK,
+			want:    account{balance: 1234},
+		},
+		{
+			name:    "add adds to the balance",
+			setup:   func() { store.Users.Deposit("alice", 1000) },
+			handler: addHandler,
+			body:    `{"UserID": "alice", "Amount": "0.05", "TransactionNum": 1}`,
+			status:  http.StatusOK,
+			want:    account{balance: 1005},
+		},
+		{
+			name:    "add rejects a negative amount",
+			setup:   func() { store.Users.Deposit("alice", 1000) },
+			handler: addHandler,
+			body:    `{"UserID": "alice", "Amount": -5, "TransactionNum": 1}`,
+			status:  http.StatusBadRequest,
+			code:    "invalid_request",
+			want:    account{balance: 1000},
+		},
+		{
+			name:    "add rejects malformed json",
+			handler: addHandler,
+			body:    `{"UserID": "alice", "Amount": "lots"}`,
+			status:  http.StatusBadRequest,
+			code:    "invalid_request",
+		},
+		{
+			name:    "set buy amount reserves the money",
+			setup:   func() { store.Users.Deposit("alice", 10000) },
+			handler: setBuyAmountHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Amount": 25, "TransactionNum": 2}`,
+			status:  http.StatusOK,
+			want:    account{balance: 7500, buyAmount: 2500, reserved: 2500},
+		},
+		{
+			name: "set buy amount adds to an existing one",
+			setup: func() {
+				store.Users.Deposit("alice", 10000)
+				ReserveFunds("alice", buyAmountReservationID("alice", "ABC"), 2500)
+				store.BuyAmounts.Add("alice", "ABC", 2500)
+			},
+			handler: setBuyAmountHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Amount": 10, "TransactionNum": 2}`,
+			status:  http.StatusOK,
+			want:    account{balance: 6500, buyAmount: 3500, reserved: 3500},
+		},
+		{
+			name:    "set buy amount needs the funds",
+			setup:   func() { store.Users.Deposit("alice", 1000) },
+			handler: setBuyAmountHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Amount": 25, "TransactionNum": 2}`,
+			status:  http.StatusConflict,
+			code:    "insufficient_funds",
+			want:    account{balance: 1000},
+		},
+		{
+			name: "cancel set buy returns the reserved money",
+			setup: func() {
+				store.Users.Deposit("alice", 10000)
+				ReserveFunds("alice", buyAmountReservationID("alice", "ABC"), 2500)
+				store.BuyAmounts.Add("alice", "ABC", 2500)
+			},
+			handler: cancelSetBuyHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "TransactionNum": 3}`,
+			status:  http.StatusOK,
+			want:    account{balance: 10000},
+		},
+		{
+			name:    "set buy trigger needs a buy amount",
+			setup:   func() { store.Users.Deposit("alice", 10000) },
+			handler: setBuyTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 10, "TransactionNum": 4}`,
+			status:  http.StatusConflict,
+			code:    "no_buy_amount",
+			want:    account{balance: 10000},
+		},
+		{
+			name: "set buy trigger needs a buy amount that pays for a share",
+			setup: func() {
+				store.Users.Deposit("alice", 10000)
+				ReserveFunds("alice", buyAmountReservationID("alice", "ABC"), 500)
+				store.BuyAmounts.Add("alice", "ABC", 500)
+			},
+			handler: setBuyTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 10, "TransactionNum": 4}`,
+			status:  http.StatusUnprocessableEntity,
+			code:    "amount_too_small",
+			want:    account{balance: 9500, buyAmount: 500, reserved: 500},
+		},
+		{
+			name:    "set buy trigger rejects a price of zero",
+			handler: setBuyTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 0, "TransactionNum": 4}`,
+			status:  http.StatusBadRequest,
+			code:    "invalid_request",
+		},
+		{
+			name:    "set sell amount doesn't reserve shares",
+			setup:   func() { store.Holdings.Add("alice", "ABC", 10) },
+			handler: setSellAmountHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Amount": 50, "TransactionNum": 5}`,
+			status:  http.StatusOK,
+			want:    account{shares: 10, sellAmount: 5000},
+		},
+		{
+			name: "set sell trigger reserves the shares the amount is worth",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 10)
+				store.SellAmounts.Add("alice", "ABC", 5000)
+			},
+			handler: setSellTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 12, "TransactionNum": 6}`,
+			status:  http.StatusOK,
+			want:    account{shares: 6, sellAmount: 5000, sharesHeld: 4, sellTrigger: true},
+		},
+		{
+			name: "set sell trigger needs a sell amount",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 10)
+			},
+			handler: setSellTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 12, "TransactionNum": 6}`,
+			status:  http.StatusConflict,
+			code:    "no_sell_amount",
+			want:    account{shares: 10},
+		},
+		{
+			name: "set sell trigger needs the shares",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 2)
+				store.SellAmounts.Add("alice", "ABC", 5000)
+			},
+			handler: setSellTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 12, "TransactionNum": 6}`,
+			status:  http.StatusConflict,
+			code:    "insufficient_shares",
+			want:    account{shares: 2, sellAmount: 5000},
+		},
+		{
+			name: "resetting a sell trigger at a lower price reserves only the extra shares",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 10)
+				store.SellAmounts.Add("alice", "ABC", 5000)
+				ReserveShares("alice", sellAmountReservationID("alice", "ABC"), "ABC", 4)
+				store.Triggers.Set(activeTrigger{"alice", "ABC", "sell", 1200, 6})
+			},
+			handler: setSellTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 10, "TransactionNum": 7}`,
+			status:  http.StatusOK,
+			want:    account{shares: 5, sellAmount: 5000, sharesHeld: 5, sellTrigger: true},
+		},
+		{
+			name: "resetting a sell trigger keeps the old reservation when the new one can't be made",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 5)
+				store.SellAmounts.Add("alice", "ABC", 5000)
+				ReserveShares("alice", sellAmountReservationID("alice", "ABC"), "ABC", 4)
+				store.Triggers.Set(activeTrigger{"alice", "ABC", "sell", 1200, 6})
+			},
+			handler: setSellTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 5, "TransactionNum": 7}`,
+			status:  http.StatusConflict,
+			code:    "insufficient_shares",
+			want:    account{shares: 1, sellAmount: 5000, sharesHeld: 4, sellTrigger: true},
+		},
+		{
+			name: "resetting a sell trigger at a higher price releases the extra shares",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 10)
+				store.SellAmounts.Add("alice", "ABC", 5000)
+				ReserveShares("alice", sellAmountReservationID("alice", "ABC"), "ABC", 4)
+				store.Triggers.Set(activeTrigger{"alice", "ABC", "sell", 1200, 6})
+			},
+			handler: setSellTriggerHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "Price": 25, "TransactionNum": 7}`,
+			status:  http.StatusOK,
+			want:    account{shares: 8, sellAmount: 5000, sharesHeld: 2, sellTrigger: true},
+		},
+		{
+			name: "cancel set sell returns the reserved shares",
+			setup: func() {
+				store.Holdings.Add("alice", "ABC", 10)
+				store.SellAmounts.Add("alice", "ABC", 5000)
+				ReserveShares("alice", sellAmountReservationID("alice", "ABC"), "ABC", 4)
+				store.Triggers.Set(activeTrigger{"alice", "ABC", "sell", 1200, 6})
+			},
+			handler: cancelSetSellHandler,
+			body:    `{"UserID": "alice", "Symbol": "ABC", "TransactionNum": 8}`,
+			status:  http.StatusOK,
+			want:    account{shares: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore(t)
+			if tt.setup != nil {
+				tt.setup()
+			}
+
+			status, res := runCommand(t, tt.handler, tt.body)
+			if status != tt.status || res.Code != tt.code {
+				t.Errorf("replied %d %q (%s), want %d %q", status, res.Code, res.Message, tt.status, tt.code)
+			}
+			wantStatus := "ok"
+			if tt.status != http.StatusOK {
+				wantStatus = "error"
+			}
+			if res.Status != wantStatus {
+				t.Errorf("status = %q, want %q", res.Status, wantStatus)
+			}
+			checkAccount(t, tt.want)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/migrate"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+var (
+	errNoUser    = errors.New("user does not exist")
+	errNoAmount  = errors.New("no amount is set for the stock")
+	errNoTrigger = errors.New("trigger does not exist")
+
+	// A statement that should have changed a row didn't
+	errNoRowsChanged = errors.New("no rows were changed")
+)
+
+// The balance of each user's account
+type UserRepository interface {
+	// Returns the user's balance, or errNoUser if they don't have an account
+	Balance(UserID string) (money.Money, error)
+	// Creates an account with a balance of 0. Does nothing if the user already has one
+	Create(UserID string) error
+	// Adds money to the user's balance, creating their account if they don't have one
+	Deposit(UserID string, amount money.Money) error
+	// Removes money from the user's balance, or returns errInsufficientFunds if the balance doesn't cover it
+	Withdraw(UserID string, amount money.Money) error
+}
+
+// The shares of each stock that users own
+type HoldingRepository interface {
+	// Returns every stock the user owns at least one share of, ordered by symbol
+	List(UserID string) ([]holding, error)
+	Add(UserID string, Symbol string, quantity int) error
+	// Removes shares from the user's holdings, or returns errInsufficientShares if they don't own enough
+	Remove(UserID string, Symbol string, quantity int) error
+}
+
+// The money set aside by SET_BUY_AMOUNT or SET_SELL_AMOUNT for each user and stock
+type AmountRepository interface {
+	// Returns the amount set for the stock, or errNoAmount if there isn't one
+	Get(UserID string, Symbol string) (money.Money, error)
+	// Adds to the amount set for the stock, creating it if there isn't one
+	Add(UserID string, Symbol string, amount money.Money) error
+	Delete(UserID string, Symbol string) error
+	// Returns every amount the user has set, ordered by symbol
+	List(UserID string) ([]automatedAmount, error)
+}
+
+// The buy and sell triggers users have set
+type TriggerRepository interface {
+	// Returns the trigger, or errNoTrigger if the user hasn't set one
+	Get(UserID string, Symbol string, method string) (activeTrigger, error)
+	// Creates a trigger. If the user already set one for the stock and method, only its price is changed
+	Set(t activeTrigger) error
+	Delete(UserID string, Symbol string, method string) error
+	// Returns every trigger the user has set, ordered by symbol and method
+	List(UserID string) ([]trigger, error)
+	// Returns every trigger of every user
+	All() ([]activeTrigger, error)
+}
+
+// The funds and shares held for orders and triggers until they are released or settled
+type ReservationRepository interface {
+	// Adds money to a reservation, creating it if it doesn't exist
+	AddFunds(reservationID string, UserID string, amount money.Money) error
+	// Deletes a reservation of funds and returns the amount it held, or errNoReservation if it doesn't exist.
+	// Only one caller can ever take a given reservation.
+	TakeFunds(reservationID string, UserID string) (money.Money, error)
+	// Returns the total amount of money held in the user's reservations
+	TotalFunds(UserID string) (money.Money, error)
+
+	// Adds shares to a reservation, creating it if it doesn't exist
+	AddShares(reservationID string, UserID string, Symbol string, quantity int) error
+	// Deletes a reservation of shares and returns the stock and number of shares it held, or
+	// errNoReservation if it doesn't exist. Only one caller can ever take a given reservation.
+	TakeShares(reservationID string, UserID string) (string, int, error)
+	// Returns every reservation of shares the user has, ordered by symbol
+	ListShares(UserID string) ([]reservedShares, error)
+}
+
+// Everything the transaction server keeps in its database
+type Store struct {
+	Users        UserRepository
+	Holdings     HoldingRepository
+	BuyAmounts   AmountRepository
+	SellAmounts  AmountRepository
+	Triggers     TriggerRepository
+	Reservations ReservationRepository
+
+	// Applies the database's migrations. nil when the store has no schema
+	Schema *migrate.Runner
+
+	// Checks that the database can be queried
+	Ping func(ctx context.Context) error
+}
+
+// Chooses the store from the config. Exits if it can't be created, rather than serve from the wrong one
+func loadStore() *Store {
+	store, err := newStore(cfg.Database, cfg.DatabaseURL)
+	if err != nil {
+		slog.Error("Failed to open the database", "database", cfg.Database, "error", err)
+		os.Exit(1)
+	}
+	return store
+}
+
+// Creates a store
+// Parameters:
+// 		name: 		the type of database, one of ("crate", "postgres", "memory")
+// 		addr:		the address of the database. Uses the database's default when empty
+//
+func newStore(name string, addr string) (*Store, error) {
+	switch name {
+	case "", "crate":
+		if addr == "" {
+			addr = "http://localhost:4200"
+		}
+		return newSQLStore("crate", addr, crateDialect)
+	case "postgres":
+		if addr == "" {
+			addr = "postgres://postgres@localhost:5432/transactions?sslmode=disable"
+		}
+		return newSQLStore("postgres", addr, postgresDialect)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown database %q", name)
+}
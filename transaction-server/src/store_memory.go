@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+type userSymbol struct {
+	UserID string
+	Symbol string
+}
+
+type userSymbolMethod struct {
+	UserID string
+	Symbol string
+	Method string
+}
+
+type fundsReservation struct {
+	UserID string
+	Amount money.Money
+}
+
+type sharesReservation struct {
+	UserID   string
+	Symbol   string
+	Quantity int
+}
+
+// A store that keeps everything in process memory, for running the transaction server without a
+// database. Nothing survives a restart.
+type memoryStore struct {
+	mu             sync.Mutex
+	balances       map[string]money.Money
+	stocks         map[userSymbol]int
+	buyAmounts     map[userSymbol]money.Money
+	sellAmounts    map[userSymbol]money.Money
+	triggers       map[userSymbolMethod]activeTrigger
+	reservedFunds  map[string]fundsReservation
+	reservedShares map[string]sharesReservation
+}
+
+func newMemoryStore() *Store {
+	s := &memoryStore{
+		balances:       map[string]money.Money{},
+		stocks:         map[userSymbol]int{},
+		buyAmounts:     map[userSymbol]money.Money{},
+		sellAmounts:    map[userSymbol]money.Money{},
+		triggers:       map[userSymbolMethod]activeTrigger{},
+		reservedFunds:  map[string]fundsReservation{},
+		reservedShares: map[string]sharesReservation{},
+	}
+	return &Store{
+		Users:        memoryUsers{s},
+		Holdings:     memoryHoldings{s},
+		BuyAmounts:   memoryAmounts{s, s.buyAmounts},
+		SellAmounts:  memoryAmounts{s, s.sellAmounts},
+		Triggers:     memoryTriggers{s},
+		Reservations: memoryReservations{s},
+		Ping:         func(ctx context.Context) error { return nil },
+	}
+}
+
+type memoryUsers struct{ *memoryStore }
+
+func (s memoryUsers) Balance(UserID string) (money.Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	balance, ok := s.balances[UserID]
+	if !ok {
+		return 0, errNoUser
+	}
+	return balance, nil
+}
+
+func (s memoryUsers) Create(UserID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.balances[UserID]; !ok {
+		s.balances[UserID] = 0
+	}
+	return nil
+}
+
+func (s memoryUsers) Deposit(UserID string, amount money.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.balances[UserID] += amount
+	return nil
+}
+
+func (s memoryUsers) Withdraw(UserID string, amount money.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	balance, ok := s.balances[UserID]
+	if !ok || balance < amount {
+		return errInsufficientFunds
+	}
+	s.balances[UserID] = balance - amount
+	return nil
+}
+
+type memoryHoldings struct{ *memoryStore }
+
+func (s memoryHoldings) List(UserID string) ([]holding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holdings := []holding{}
+	for key, quantity := range s.stocks {
+		if key.UserID == UserID && quantity > 0 {
+			holdings = append(holdings, holding{key.Symbol, quantity})
+		}
+	}
+	sort.Slice(holdings, func(i, j int) bool { return holdings[i].Symbol < holdings[j].Symbol })
+	return holdings, nil
+}
+
+func (s memoryHoldings) Add(UserID string, Symbol string, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stocks[userSymbol{UserID, Symbol}] += quantity
+	return nil
+}
+
+func (s memoryHoldings) Remove(UserID string, Symbol string, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := userSymbol{UserID, Symbol}
+	owned, ok := s.stocks[key]
+	if !ok || owned < quantity {
+		return errInsufficientShares
+	}
+	s.stocks[key] = owned - quantity
+	return nil
+}
+
+// The amounts in either buyAmounts or sellAmounts
+type memoryAmounts struct {
+	*memoryStore
+	amounts map[userSymbol]money.Money
+}
+
+func (s memoryAmounts) Get(UserID string, Symbol string) (money.Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	amount, ok := s.amounts[userSymbol{UserID, Symbol}]
+	if !ok {
+		return 0, errNoAmount
+	}
+	return amount, nil
+}
+
+func (s memoryAmounts) Add(UserID string, Symbol string, amount money.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.amounts[userSymbol{UserID, Symbol}] += amount
+	return nil
+}
+
+func (s memoryAmounts) Delete(UserID string, Symbol string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.amounts, userSymbol{UserID, Symbol})
+	return nil
+}
+
+func (s memoryAmounts) List(UserID string) ([]automatedAmount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	amounts := []automatedAmount{}
+	for key, amount := range s.amounts {
+		if key.UserID == UserID {
+			amounts = append(amounts, automatedAmount{key.Symbol, amount})
+		}
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i].Symbol < amounts[j].Symbol })
+	return amounts, nil
+}
+
+type memoryTriggers struct{ *memoryStore }
+
+func (s memoryTriggers) Get(UserID string, Symbol string, method string) (activeTrigger, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.triggers[userSymbolMethod{UserID, Symbol, method}]
+	if !ok {
+		return activeTrigger{UserID: UserID, Symbol: Symbol, Method: method}, errNoTrigger
+	}
+	return t, nil
+}
+
+func (s memoryTriggers) Set(t activeTrigger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := userSymbolMethod{t.UserID, t.Symbol, t.Method}
+	if existing, ok := s.triggers[key]; ok {
+		// Only the price changes, the same as the ON CONFLICT in the SQL store
+		existing.Price = t.Price
+		s.triggers[key] = existing
+		return nil
+	}
+	s.triggers[key] = t
+	return nil
+}
+
+func (s memoryTriggers) Delete(UserID string, Symbol string, method string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.triggers, userSymbolMethod{UserID, Symbol, method})
+	return nil
+}
+
+func (s memoryTriggers) List(UserID string) ([]trigger, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []trigger{}
+	for _, t := range s.triggers {
+		if t.UserID == UserID {
+			list = append(list, trigger{t.Symbol, t.Method, t.Price, t.TransactionNum})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Symbol != list[j].Symbol {
+			return list[i].Symbol < list[j].Symbol
+		}
+		return list[i].Method < list[j].Method
+	})
+	return list, nil
+}
+
+func (s memoryTriggers) All() ([]activeTrigger, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]activeTrigger, 0, len(s.triggers))
+	for _, t := range s.triggers {
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+type memoryReservations struct{ *memoryStore }
+
+func (s memoryReservations) AddFunds(reservationID string, UserID string, amount money.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.reservedFunds[reservationID]
+	s.reservedFunds[reservationID] = fundsReservation{UserID, r.Amount + amount}
+	return nil
+}
+
+func (s memoryReservations) TakeFunds(reservationID string, UserID string) (money.Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.reservedFunds[reservationID]
+	if !ok || r.UserID != UserID {
+		return 0, errNoReservation
+	}
+	delete(s.reservedFunds, reservationID)
+	return r.Amount, nil
+}
+
+func (s memoryReservations) TotalFunds(UserID string) (money.Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total money.Money
+	for _, r := range s.reservedFunds {
+		if r.UserID == UserID {
+			total += r.Amount
+		}
+	}
+	return total, nil
+}
+
+func (s memoryReservations) AddShares(reservationID string, UserID string, Symbol string, quantity int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.reservedShares[reservationID]
+	s.reservedShares[reservationID] = sharesReservation{UserID, Symbol, r.Quantity + quantity}
+	return nil
+}
+
+func (s memoryReservations) TakeShares(reservationID string, UserID string) (string, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.reservedShares[reservationID]
+	if !ok || r.UserID != UserID {
+		return "", 0, errNoReservation
+	}
+	delete(s.reservedShares, reservationID)
+	return r.Symbol, r.Quantity, nil
+}
+
+func (s memoryReservations) ListShares(UserID string) ([]reservedShares, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []reservedShares{}
+	for id, r := range s.reservedShares {
+		if r.UserID == UserID {
+			list = append(list, reservedShares{r.Symbol, r.Quantity, id})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Symbol < list[j].Symbol })
+	return list, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/metrics"
+	"github.com/LeeZeitz/DayTradingSystem/shared/migrate"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	_ "github.com/herenow/go-crate"
+	_ "github.com/lib/pq"
+)
+
+// The differences between the SQL accepted by CrateDB and PostgreSQL
+type sqlDialect struct {
+	// Returns how an ON CONFLICT DO UPDATE refers to the existing value of a column
+	existing func(table string, column string) string
+
+	// Whether a table has to be refreshed before queries can see writes to it
+	refresh bool
+}
+
+var (
+	crateDialect = sqlDialect{
+		existing: func(table string, column string) string { return column },
+		refresh:  true,
+	}
+
+	// Postgres can't tell the existing row's column from the excluded row's unless it's qualified
+	postgresDialect = sqlDialect{
+		existing: func(table string, column string) string { return table + "." + column },
+	}
+)
+
+// A store backed by a SQL database. The schema is in migrations.go.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// Connects to a SQL database
+// Parameters:
+// 		driver: 	the database/sql driver to connect with, one of ("crate", "postgres")
+// 		addr:		the address of the database
+// 		dialect:	the SQL dialect the database speaks
+//
+func newSQLStore(driver string, addr string, dialect sqlDialect) (*Store, error) {
+	db, err := sql.Open(driver, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db, dialect}
+	return &Store{
+		Users:        sqlUsers{s},
+		Holdings:     sqlHoldings{s},
+		BuyAmounts:   sqlAmounts{s, "buy_amounts"},
+		SellAmounts:  sqlAmounts{s, "sell_amounts"},
+		Triggers:     sqlTriggers{s},
+		Reservations: sqlReservations{s},
+		Schema:       migrate.NewRunner(db, migrations, dialect.refresh),
+		Ping:         s.ping,
+	}, nil
+}
+
+func (s *sqlStore) ping(ctx context.Context) error {
+	var one int
+	return s.db.QueryRowContext(ctx, "SELECT 1;").Scan(&one)
+}
+
+// Runs a statement that has to change exactly one row. Returns failure if it changed none.
+func (s *sqlStore) execOne(failure error, query string, args ...interface{}) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	numrows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if numrows < 1 {
+		return failure
+	}
+	return nil
+}
+
+type sqlUsers struct{ *sqlStore }
+
+func (s sqlUsers) Balance(UserID string) (money.Money, error) {
+	defer metrics.TimeQuery("users.balance")()
+	var balance money.Money
+	err := s.db.QueryRow("SELECT balance FROM users WHERE user_id = $1;", UserID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, errNoUser
+	}
+	return balance, err
+}
+
+func (s sqlUsers) Create(UserID string) error {
+	defer metrics.TimeQuery("users.create")()
+	_, err := s.db.Exec("INSERT INTO users (user_id, balance) VALUES ($1, 0) ON CONFLICT (user_id) DO NOTHING;", UserID)
+	return err
+}
+
+func (s sqlUsers) Deposit(UserID string, amount money.Money) error {
+	defer metrics.TimeQuery("users.deposit")()
+	// Insert new user if they don't already exist, otherwise update their balance
+	queryString := "INSERT INTO users (user_id, balance) VALUES ($1, $2) " +
+		"ON CONFLICT (user_id) DO UPDATE SET balance = " + s.dialect.existing("users", "balance") + " + $2;"
+	return s.execOne(errNoRowsChanged, queryString, UserID, amount)
+}
+
+func (s sqlUsers) Withdraw(UserID string, amount money.Money) error {
+	defer metrics.TimeQuery("users.withdraw")()
+	// Only withdraw the money if the balance covers it
+	queryString := "UPDATE users SET balance = balance - $1 WHERE user_id = $2 AND balance >= $1;"
+	return s.execOne(errInsufficientFunds, queryString, amount, UserID)
+}
+
+type sqlHoldings struct{ *sqlStore }
+
+func (s sqlHoldings) List(UserID string) ([]holding, error) {
+	defer metrics.TimeQuery("holdings.list")()
+	holdings := []holding{}
+	rows, err := s.db.Query("SELECT symbol, quantity FROM stocks WHERE user_id = $1 AND quantity > 0 ORDER BY symbol;", UserID)
+	if err != nil {
+		return holdings, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := holding{}
+		if err := rows.Scan(&h.Symbol, &h.Quantity); err != nil {
+			return holdings, err
+		}
+		holdings = append(holdings, h)
+	}
+	return holdings, rows.Err()
+}
+
+func (s sqlHoldings) Add(UserID string, Symbol string, quantity int) error {
+	defer metrics.TimeQuery("holdings.add")()
+	queryString := "INSERT INTO stocks (quantity, symbol, user_id) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (user_id, symbol) DO UPDATE SET quantity = " + s.dialect.existing("stocks", "quantity") + " + $1;"
+	return s.execOne(errNoRowsChanged, queryString, quantity, Symbol, UserID)
+}
+
+func (s sqlHoldings) Remove(UserID string, Symbol string, quantity int) error {
+	defer metrics.TimeQuery("holdings.remove")()
+	// Only remove the shares if the user owns enough of them
+	queryString := "UPDATE stocks SET quantity = quantity - $1 WHERE user_id = $2 AND symbol = $3 AND quantity >= $1;"
+	return s.execOne(errInsufficientShares, queryString, quantity, UserID, Symbol)
+}
+
+// The amounts in either buy_amounts or sell_amounts
+type sqlAmounts struct {
+	*sqlStore
+	table string
+}
+
+func (s sqlAmounts) Get(UserID string, Symbol string) (money.Money, error) {
+	defer metrics.TimeQuery(s.table + ".get")()
+	var amount money.Money
+	err := s.db.QueryRow("SELECT amount FROM "+s.table+" WHERE user_id = $1 AND symbol = $2;", UserID, Symbol).Scan(&amount)
+	if err == sql.ErrNoRows {
+		return 0, errNoAmount
+	}
+	return amount, err
+}
+
+func (s sqlAmounts) Add(UserID string, Symbol string, amount money.Money) error {
+	defer metrics.TimeQuery(s.table + ".add")()
+	queryString := "INSERT INTO " + s.table + " (user_id, symbol, amount) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (user_id, symbol) DO UPDATE SET amount = " + s.dialect.existing(s.table, "amount") + " + $3;"
+	return s.execOne(errNoRowsChanged, queryString, UserID, Symbol, amount)
+}
+
+func (s sqlAmounts) Delete(UserID string, Symbol string) error {
+	defer metrics.TimeQuery(s.table + ".delete")()
+	_, err := s.db.Exec("DELETE FROM "+s.table+" WHERE user_id = $1 AND symbol = $2;", UserID, Symbol)
+	return err
+}
+
+func (s sqlAmounts) List(UserID string) ([]automatedAmount, error) {
+	defer metrics.TimeQuery(s.table + ".list")()
+	amounts := []automatedAmount{}
+	rows, err := s.db.Query("SELECT symbol, amount FROM "+s.table+" WHERE user_id = $1 ORDER BY symbol;", UserID)
+	if err != nil {
+		return amounts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := automatedAmount{}
+		if err := rows.Scan(&a.Symbol, &a.Amount); err != nil {
+			return amounts, err
+		}
+		amounts = append(amounts, a)
+	}
+	return amounts, rows.Err()
+}
+
+type sqlTriggers struct{ *sqlStore }
+
+func (s sqlTriggers) Get(UserID string, Symbol string, method string) (activeTrigger, error) {
+	defer metrics.TimeQuery("triggers.get")()
+	t := activeTrigger{UserID: UserID, Symbol: Symbol, Method: method}
+	queryString := "SELECT price, transaction_num FROM triggers WHERE user_id = $1 AND symbol = $2 AND method = $3;"
+	err := s.db.QueryRow(queryString, UserID, Symbol, method).Scan(&t.Price, &t.TransactionNum)
+	if err == sql.ErrNoRows {
+		return t, errNoTrigger
+	}
+	return t, err
+}
+
+func (s sqlTriggers) Set(t activeTrigger) error {
+	defer metrics.TimeQuery("triggers.set")()
+	queryString := "INSERT INTO triggers (user_id, symbol, price, method, transaction_num) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT (user_id, symbol, method) DO UPDATE SET price = $3;"
+	return s.execOne(errNoRowsChanged, queryString, t.UserID, t.Symbol, t.Price, t.Method, t.TransactionNum)
+}
+
+func (s sqlTriggers) Delete(UserID string, Symbol string, method string) error {
+	defer metrics.TimeQuery("triggers.delete")()
+	_, err := s.db.Exec("DELETE FROM triggers WHERE user_id = $1 AND symbol = $2 AND method = $3;", UserID, Symbol, method)
+	return err
+}
+
+func (s sqlTriggers) List(UserID string) ([]trigger, error) {
+	defer metrics.TimeQuery("triggers.list")()
+	list := []trigger{}
+	rows, err := s.db.Query("SELECT symbol, method, price, transaction_num FROM triggers WHERE user_id = $1 ORDER BY symbol, method;", UserID)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := trigger{}
+		if err := rows.Scan(&t.Symbol, &t.Method, &t.Price, &t.TransactionNum); err != nil {
+			return list, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (s sqlTriggers) All() ([]activeTrigger, error) {
+	defer metrics.TimeQuery("triggers.all")()
+	list := []activeTrigger{}
+	rows, err := s.db.Query("SELECT user_id, symbol, method, price, transaction_num FROM triggers;")
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := activeTrigger{}
+		if err := rows.Scan(&t.UserID, &t.Symbol, &t.Method, &t.Price, &t.TransactionNum); err != nil {
+			return list, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+type sqlReservations struct{ *sqlStore }
+
+func (s sqlReservations) AddFunds(reservationID string, UserID string, amount money.Money) error {
+	defer metrics.TimeQuery("reservations.add_funds")()
+	queryString := "INSERT INTO reserved_funds (reservation_id, user_id, amount) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (reservation_id) DO UPDATE SET amount = " + s.dialect.existing("reserved_funds", "amount") + " + $3;"
+	_, err := s.db.Exec(queryString, reservationID, UserID, amount)
+	return err
+}
+
+// The delete only succeeds if the amount hasn't changed since it was read, so only one caller
+// can ever take a given reservation.
+func (s sqlReservations) TakeFunds(reservationID string, UserID string) (money.Money, error) {
+	defer metrics.TimeQuery("reservations.take_funds")()
+	for attempt := 0; attempt < 3; attempt++ {
+		var amount money.Money
+		queryString := "SELECT amount FROM reserved_funds WHERE reservation_id = $1 AND user_id = $2;"
+		err := s.db.QueryRow(queryString, reservationID, UserID).Scan(&amount)
+		if err == sql.ErrNoRows {
+			return 0, errNoReservation
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		queryString = "DELETE FROM reserved_funds WHERE reservation_id = $1 AND amount = $2;"
+		err = s.execOne(errReservationBusy, queryString, reservationID, amount)
+		if err == nil {
+			return amount, nil
+		}
+		if err != errReservationBusy {
+			return 0, err
+		}
+	}
+	return 0, errReservationBusy
+}
+
+func (s sqlReservations) TotalFunds(UserID string) (money.Money, error) {
+	defer metrics.TimeQuery("reservations.total_funds")()
+	var total money.Money
+	err := s.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM reserved_funds WHERE user_id = $1;", UserID).Scan(&total)
+	return total, err
+}
+
+func (s sqlReservations) AddShares(reservationID string, UserID string, Symbol string, quantity int) error {
+	defer metrics.TimeQuery("reservations.add_shares")()
+	queryString := "INSERT INTO reserved_shares (reservation_id, user_id, symbol, quantity) VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT (reservation_id) DO UPDATE SET quantity = " + s.dialect.existing("reserved_shares", "quantity") + " + $4;"
+	_, err := s.db.Exec(queryString, reservationID, UserID, Symbol, quantity)
+	return err
+}
+
+func (s sqlReservations) TakeShares(reservationID string, UserID string) (string, int, error) {
+	defer metrics.TimeQuery("reservations.take_shares")()
+	for attempt := 0; attempt < 3; attempt++ {
+		var symbol string
+		var quantity int
+		queryString := "SELECT symbol, quantity FROM reserved_shares WHERE reservation_id = $1 AND user_id = $2;"
+		err := s.db.QueryRow(queryString, reservationID, UserID).Scan(&symbol, &quantity)
+		if err == sql.ErrNoRows {
+			return "", 0, errNoReservation
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		queryString = "DELETE FROM reserved_shares WHERE reservation_id = $1 AND quantity = $2;"
+		err = s.execOne(errReservationBusy, queryString, reservationID, quantity)
+		if err == nil {
+			return symbol, quantity, nil
+		}
+		if err != errReservationBusy {
+			return "", 0, err
+		}
+	}
+	return "", 0, errReservationBusy
+}
+
+func (s sqlReservations) ListShares(UserID string) ([]reservedShares, error) {
+	defer metrics.TimeQuery("reservations.list_shares")()
+	list := []reservedShares{}
+	rows, err := s.db.Query("SELECT symbol, quantity, reservation_id FROM reserved_shares WHERE user_id = $1 ORDER BY symbol;", UserID)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := reservedShares{}
+		if err := rows.Scan(&r.Symbol, &r.Quantity, &r.ReservationID); err != nil {
+			return list, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+// Number of recent account transactions to include in a summary
+const summaryTransactionLimit = 20
+
+type holding struct {
+	Symbol   string
+	Quantity int
+}
+
+type reservedShares struct {
+	Symbol        string
+	Quantity      int
+	ReservationID string
+}
+
+type automatedAmount struct {
+	Symbol string
+	Amount money.Money
+}
+
+type trigger struct {
+	Symbol         string
+	Method         string
+	Price          money.Money
+	TransactionNum int
+}
+
+// Everything about a user's account, as returned by DISPLAY_SUMMARY
+type accountSummary struct {
+	UserID         string
+	Balance        money.Money
+	ReservedFunds  money.Money
+	Stocks         []holding
+	ReservedShares []reservedShares
+	PendingBuys    []pendingOrder
+	PendingSells   []pendingOrder
+	BuyAmounts     []automatedAmount
+	SellAmounts    []automatedAmount
+	Triggers       []trigger
+	Transactions   []json.RawMessage // most recent account transactions from the audit server, newest first
+}
+
+// Collects a snapshot of everything in a user's account
+// Parameters:
+// 		ctx: 			the context of the DISPLAY_SUMMARY command
+// 		UserID: 		the id of the user to summarize
+//
+func getAccountSummary(ctx context.Context, UserID string) (accountSummary, error) {
+	summary := accountSummary{
+		UserID:         UserID,
+		Stocks:         []holding{},
+		ReservedShares: []reservedShares{},
+		BuyAmounts:     []automatedAmount{},
+		SellAmounts:    []automatedAmount{},
+		Triggers:       []trigger{},
+		Transactions:   []json.RawMessage{},
+	}
+
+	// A user who has never added money has no account, so their balance is just 0
+	var err error
+	summary.Balance, err = store.Users.Balance(UserID)
+	if err != nil && err != errNoUser {
+		return summary, err
+	}
+
+	summary.ReservedFunds, err = store.Reservations.TotalFunds(UserID)
+	if err != nil {
+		return summary, err
+	}
+	summary.Stocks, err = store.Holdings.List(UserID)
+	if err != nil {
+		return summary, err
+	}
+	summary.ReservedShares, err = store.Reservations.ListShares(UserID)
+	if err != nil {
+		return summary, err
+	}
+	summary.BuyAmounts, err = store.BuyAmounts.List(UserID)
+	if err != nil {
+		return summary, err
+	}
+	summary.SellAmounts, err = store.SellAmounts.List(UserID)
+	if err != nil {
+		return summary, err
+	}
+	summary.Triggers, err = store.Triggers.List(UserID)
+	if err != nil {
+		return summary, err
+	}
+
+	summary.PendingBuys, err = getPendingOrders(UserID, "buy")
+	if err != nil {
+		return summary, err
+	}
+	summary.PendingSells, err = getPendingOrders(UserID, "sell")
+	if err != nil {
+		return summary, err
+	}
+
+	// The transaction history is nice to have, so the summary is still returned without it
+	transactions, err := getRecentTransactions(ctx, UserID)
+	if err != nil {
+		failGracefully(err, "Failed to get recent transactions from audit server")
+	} else {
+		summary.Transactions = transactions
+	}
+
+	return summary, nil
+}
+
+// Returns the user's pending orders, most recent first. Orders that have expired but haven't
+// been swept yet are left out.
+func getPendingOrders(UserID string, method string) ([]pendingOrder, error) {
+	orders := []pendingOrder{}
+	members, err := cache.LRange(pendingOrderKey(UserID, method), 0, -1).Result()
+	if err != nil {
+		return orders, err
+	}
+
+	for _, member := range members {
+		var order pendingOrder
+		if err := json.Unmarshal([]byte(member), &order); err != nil {
+			return orders, err
+		}
+		if !order.expired() {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// Retrieves the user's most recent account transactions from the audit server
+func getRecentTransactions(ctx context.Context, UserID string) ([]json.RawMessage, error) {
+	transactions := []json.RawMessage{}
+
+	req := struct {
+		UserID string
+		Limit  int
+	}{UserID, summaryTransactionLimit}
+
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(req)
+	r, err := postAudit(ctx, "/userTransactions", b)
+	if err != nil {
+		return transactions, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return transactions, fmt.Errorf("%w: %s", errAuditUnavailable, r.Status)
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&transactions)
+	return transactions, err
+}
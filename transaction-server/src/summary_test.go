@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecentTransactionsFailOnErrorStatus(t *testing.T) {
+	audit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"Error": "database unavailable"}`, http.StatusInternalServerError)
+	}))
+	defer audit.Close()
+	saved := auditServer
+	auditServer = audit.URL
+	defer func() { auditServer = saved }()
+
+	transactions, err := getRecentTransactions(context.Background(), "alice")
+	if !errors.Is(err, errAuditUnavailable) {
+		t.Errorf("getRecentTransactions() error = %v, want %v", err, errAuditUnavailable)
+	}
+	if len(transactions) != 0 {
+		t.Errorf("getRecentTransactions() = %v, want none", transactions)
+	}
+}
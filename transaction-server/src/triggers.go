@@ -1,141 +1,449 @@
 package main
 
 import (
-	"database/sql"
-
-	"strconv"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
 	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/LeeZeitz/DayTradingSystem/shared/shutdown"
 )
 
 // Consumes a trigger and performs any buy/sell actions associated with it
 // Parameters:
+// 		ctx: 			the context the trigger fires in
 // 		UserID: 		(string) id of the user who owns the trigger to fire
 // 		Symbol: 		(string) the symbol of the stock being triggered
 //		method:			(string) the type of action to perform, one of ("buy", "sell")
+// 		price:			the quoted price of the stock that fired the trigger
 //
-func fireTrigger(UserID string, Symbol string, method string) {
+func fireTrigger(ctx context.Context, UserID string, Symbol string, method string, price money.Money) {
+	cmd := commandInfo{0, triggerCommand(method), UserID, Symbol, price}
 
 	// Get transaction num
-	var transactionNum int
-	queryString := "SELECT transaction_num FROM triggers WHERE user_id = $1 AND symbol = $2 AND method = $3;"
-	stmt, err := db.Prepare(queryString)
+	t, err := store.Triggers.Get(UserID, Symbol, method)
 	if err != nil {
-		failGracefully(err, "Failed to prepare transactionNum query")
-		return
-	}
-	err = stmt.QueryRow(UserID, Symbol, method).Scan(&transactionNum)
-
-	if err != nil {
-		failGracefully(err, "Failed to get transactionNum")
+		reportError(ctx, cmd, err, "Failed to get transactionNum")
 		return
 	}
+	transactionNum := t.TransactionNum
+	cmd.TransactionNum = transactionNum
 
 	// Consume trigger
-	queryString = "DELETE FROM triggers WHERE user_id = $1 AND symbol = $2 AND method = $3;"
-	rows, err := db.Query(queryString, UserID, Symbol, method)
+	err = store.Triggers.Delete(UserID, Symbol, method)
 	if err != nil{
-		failGracefully(err, "Failed to delete trigger after firing")
+		reportError(ctx, cmd, err, "Failed to delete trigger after firing")
 		return
 	}
-	defer rows.Close()
 
-	whereCond := "WHERE user_id = $1 AND symbol = $2"
+	// Add/subtract the stocks to user's account
+	if method == "buy" {
+		fireBuyTrigger(ctx, UserID, Symbol, price, transactionNum)
+	} else {
+		fireSellTrigger(ctx, UserID, Symbol, price, transactionNum)
+	}
+}
+
+// Spends a user's buy amount on as many whole shares as it can pay for at the given price.
+// Whatever is left over is returned to the user's balance.
+// Parameters:
+// 		ctx: 			the context the trigger fires in
+// 		UserID: 		(string) id of the user who owns the trigger
+// 		Symbol: 		(string) the symbol of the stock to buy
+// 		price:			the quoted price of a single share
+// 		transactionNum:	the transaction number of the command that set the trigger
+//
+func fireBuyTrigger(ctx context.Context, UserID string, Symbol string, price money.Money, transactionNum int) {
+	cmd := commandInfo{transactionNum, "SET_BUY_TRIGGER", UserID, Symbol, price}
 
-	var quantity int
-	// Get quantity of stock to buy/sell
-	queryString = "SELECT quantity FROM " + method + "_amounts " + whereCond
-	stmt, err = db.Prepare(queryString)
+	// Take the money that was reserved when the buy amount was set
+	reserved, err := SettleFunds(UserID, buyAmountReservationID(UserID, Symbol))
 	if err != nil {
-		failGracefully(err, "Failed to prepare SELECT quantity query")
+		reportError(ctx, cmd, err, "Failed to settle reserved funds for buy trigger")
 		return
 	}
-	err = stmt.QueryRow(UserID, Symbol).Scan(&quantity)
+
+	// The buy amount is used up whether or not it could pay for a share
+	err = store.BuyAmounts.Delete(UserID, Symbol)
 	if err != nil {
-		failGracefully(err, "Failed to get quantity from "+method+"_amounts")
+		reportError(ctx, cmd, err, "Failed to delete buy amount after trigger fire")
+	}
+
+	shares := reserved.Shares(price)
+	cost := price.Mul(shares)
+
+	if remainder := reserved - cost; remainder > 0 {
+		err = refundFunds(UserID, remainder)
+		if err != nil {
+			reportError(ctx, cmd, err, "Failed to refund the rest of the buy amount")
+		} else {
+			logAccountTransaction(ctx, transactionNum, "transaction-server", "release", UserID, remainder)
+		}
+	}
+	if shares == 0 {
+		cmd.Funds = reserved
+		reportError(ctx, cmd, errAmountTooSmall, "Buy amount of "+reserved.String()+" can't pay for a share at "+price.String())
 		return
 	}
 
-	// Delete buy/sell amount from user's account
-	queryString = "DELETE FROM " + method + "_amounts " + whereCond
-	rows, err = db.Query(queryString, UserID, Symbol)
+	// If the shares can't be added, the user gets their money back
+	err = buyStock(ctx, UserID, Symbol, shares, cost, transactionNum)
 	if err != nil {
+		refundFunds(UserID, cost)
+		reportError(ctx, cmd, err, "Failed to add stocks to account for buy trigger")
+		return
+	}
+	logAccountTransaction(ctx, transactionNum, "transaction-server", "remove", UserID, cost)
+	logSystemEvent(ctx, transactionNum, "transaction-server", "BUY", UserID, Symbol, "", cost)
+}
+
+// Sells the shares reserved for a user's sell trigger at the given price and credits the proceeds
+// Parameters:
+// 		ctx: 			the context the trigger fires in
+// 		UserID: 		(string) id of the user who owns the trigger
+// 		Symbol: 		(string) the symbol of the stock to sell
+// 		price:			the quoted price of a single share
+// 		transactionNum:	the transaction number of the command that set the trigger
+//
+func fireSellTrigger(ctx context.Context, UserID string, Symbol string, price money.Money, transactionNum int) {
+	cmd := commandInfo{transactionNum, "SET_SELL_TRIGGER", UserID, Symbol, price}
 
-		failGracefully(err, "Failed to delete "+method+" amount after trigger fire")
+	// Sell the shares that were reserved when the trigger was set
+	shares, err := SettleShares(UserID, sellAmountReservationID(UserID, Symbol))
+	if err != nil {
+		reportError(ctx, cmd, err, "Failed to settle reserved stocks for sell trigger")
+		return
 	}
-	defer rows.Close()
 
-	// Add/subtract the stocks to user's account
-	if method == "buy" {
-		buyStock(UserID, Symbol, strconv.Itoa(quantity), transactionNum)
-		logSystemEvent(transactionNum, "transaction-server", "BUY", UserID, Symbol, "", float64(quantity))
-	} else {
-		sellStock(UserID, Symbol, strconv.Itoa(quantity), transactionNum)
-		logSystemEvent(transactionNum, "transaction-server", "SELL", UserID, Symbol, "", float64(quantity))
+	err = store.SellAmounts.Delete(UserID, Symbol)
+	if err != nil {
+		reportError(ctx, cmd, err, "Failed to delete sell amount after trigger fire")
 	}
+
+	// If the proceeds can't be credited, the user gets their shares back
+	proceeds := price.Mul(shares)
+	err = store.Users.Deposit(UserID, proceeds)
+	if err != nil {
+		refundShares(UserID, Symbol, shares)
+		cmd.Funds = proceeds
+		reportError(ctx, cmd, err, "Failed to add money for stock sale")
+		return
+	}
+	logAccountTransaction(ctx, transactionNum, "transaction-server", "add", UserID, proceeds)
+	logSystemEvent(ctx, transactionNum, "transaction-server", "SELL", UserID, Symbol, "", proceeds)
 }
 
-// Evaluates whether or not a given trigger should fire
+// Reserves the shares a user's sell amount is worth at the trigger price. If the trigger was already
+// set, only the difference from the shares reserved at its old price is reserved or released, so if the
+// user doesn't own enough shares the old reservation is left as it was.
 // Parameters:
-// 		UserID: 		(string) id of the user who owns the trigger to fire
-// 		Symbol: 		(string) the symbol of the stock being triggered
-//		method:			(string) the type of action to perform, one of ("buy", "sell")
+// 		ctx: 			the context of the SET_SELL_TRIGGER command
+// 		UserID: 		(string) id of the user setting the trigger
+// 		Symbol: 		(string) the symbol of the stock to sell
+// 		price:			the price the trigger sells at
+// 		transactionNum:	the transaction number of the SET_SELL_TRIGGER command
 //
-func evalTrigger(UserID string, Symbol string, method string) bool {
-	queryString := "SELECT price, transaction_num FROM triggers WHERE symbol = $1 AND user_id = $2 and method = $3;"	
+// Returns the number of shares reserved
+func reserveSellAmountShares(ctx context.Context, UserID string, Symbol string, price money.Money, transactionNum int) (int, error) {
+	amount, err := store.SellAmounts.Get(UserID, Symbol)
+	if err == errNoAmount {
+		return 0, errNoSellAmount
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	shares := amount.Shares(price)
+	if shares == 0 {
+		return 0, fmt.Errorf("%w: sell amount of %s at %s", errAmountTooSmall, amount, price)
+	}
+
+	// The shares already reserved are valued at the old trigger's price in the audit log
+	oldPrice := price
+	old, err := store.Triggers.Get(UserID, Symbol, "sell")
+	if err == nil {
+		oldPrice = old.Price
+	} else if err != errNoTrigger {
+		return 0, err
+	}
 
-	stmt, err := db.Prepare(queryString)
+	reservationID := sellAmountReservationID(UserID, Symbol)
+	held, err := heldShares(UserID, reservationID)
+	if err != nil {
+		return 0, err
+	}
+	if shares > held {
+		err = ReserveShares(UserID, reservationID, Symbol, shares-held)
+	} else if shares < held {
+		_, err = ReleaseSomeShares(UserID, reservationID, held-shares)
+	}
 	if err != nil {
+		return 0, err
+	}
 
-		failGracefully(err, "Failed to prepare query")
+	if held > 0 {
+		logAccountTransaction(ctx, transactionNum, "transaction-server", "release", UserID, oldPrice.Mul(held))
 	}
-	res := struct {
-		triggerPrice   float64
-		transactionNum int
-	}{0.0, 0}
+	logAccountTransaction(ctx, transactionNum, "transaction-server", "reserve", UserID, price.Mul(shares))
+	return shares, nil
+}
 
-	// Try to get a trigger for given user, symbol, and method
-	err = stmt.QueryRow(Symbol, UserID, method).Scan(&res.triggerPrice, &res.transactionNum)
-	defer stmt.Close()
+// Returns the shares reserved for a user's sell trigger to their holdings. Does nothing if no shares are reserved.
+// The shares are valued at the trigger's price in the audit log.
+func releaseSellAmountShares(ctx context.Context, UserID string, Symbol string, price money.Money, transactionNum int) error {
+	shares, err := ReleaseShares(UserID, sellAmountReservationID(UserID, Symbol))
+	if err == errNoReservation {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logAccountTransaction(ctx, transactionNum, "transaction-server", "release", UserID, price.Mul(shares))
+	return nil
+}
 
-	// If no trigger exists, stop the routine monitoring it
-	if err == sql.ErrNoRows {
-		return true
-	} else {
-		// If trigger still exists, check the value of the trigger against the price
-		quote := getQuote(Symbol, res.transactionNum, UserID)
-		diff := res.triggerPrice - quote
-		if method == "sell" {
-			diff *= -1.0
-		}
-		// If the difference if greater than or equal to 0, fire the trigger!
-		if diff >= 0 {
-			fireTrigger(UserID, Symbol, method)
-			return true
-		} else {
-			// The trigger still exists, but should not be fired yet so we are not done monitoring yet
-			return false
-		}
+// Returns the command that sets a trigger with the given method, for the audit log
+func triggerCommand(method string) string {
+	if method == "sell" {
+		return "SET_SELL_TRIGGER"
 	}
+	return "SET_BUY_TRIGGER"
+}
+
+var (
+	errNoBuyAmount  = errors.New("no buy amount is set for the stock")
+	errNoSellAmount = errors.New("no sell amount is set for the stock")
+)
+
+// A trigger that is waiting for its stock to reach its price
+type activeTrigger struct {
+	UserID         string
+	Symbol         string
+	Method         string      // "buy" or "sell"
+	Price          money.Money // buy when the stock is at or below this price, sell when at or above it
+	TransactionNum int
 }
 
-// Monitors a trigger (in a goroutine, should probably be called in a goroutine as well) as long as it exists.
-// Retrieves a quote for the trigger's stock every 60 seconds until the trigger fires or gets cancelled.
+// Returns whether the trigger should fire at the given price
+func (t *activeTrigger) reached(quote money.Money) bool {
+	if t.Method == "sell" {
+		return quote >= t.Price
+	}
+	return quote <= t.Price
+}
+
+type triggerKey struct {
+	UserID string
+	Method string
+}
+
+// Keeps every active trigger in memory, indexed by symbol. Each symbol with at least one trigger has a
+// single watcher goroutine that retrieves one quote per interval and evaluates all of the symbol's triggers against it.
+type triggerEngine struct {
+	mu       sync.Mutex
+	interval time.Duration
+	symbols  map[string]map[triggerKey]*activeTrigger
+	stopped  bool
+	done     chan struct{} // closed when the engine is stopped
+	watchers sync.WaitGroup
+}
+
+var triggers *triggerEngine
+
+func newTriggerEngine(interval time.Duration) *triggerEngine {
+	return &triggerEngine{
+		interval: interval,
+		symbols:  map[string]map[triggerKey]*activeTrigger{},
+		done:     make(chan struct{}),
+	}
+}
+
+// Starts watching a trigger, or updates the price of one that is already being watched
 // Parameters:
-// 		UserID: 		(string) id of the user who owns the trigger to fire
+// 		UserID: 		(string) id of the user who owns the trigger
 // 		Symbol: 		(string) the symbol of the stock being triggered
 //		method:			(string) the type of action to perform, one of ("buy", "sell")
+// 		price:			the price at which the trigger fires
+// 		transactionNum:	the transaction number of the command that set the trigger
 //
-func monitorTrigger(UserID string, Symbol string, method string) {
-	// Create a ticker that fires every 60 seconds
-	ticker := time.NewTicker(10 * time.Second)
-
-	// Every time the ticker fires, check the trigger
-	for _ = range ticker.C {
-		//fmt.Println("Tick at", i)
-		done := evalTrigger(UserID, Symbol, method)
-		if done {
-			//fmt.Println("here")
+func (e *triggerEngine) add(UserID string, Symbol string, method string, price money.Money, transactionNum int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Once the server is stopping, triggers stay in the database and are recovered on the next start
+	if e.stopped {
+		return
+	}
+
+	key := triggerKey{UserID, method}
+	watched, ok := e.symbols[Symbol]
+	if !ok {
+		watched = map[triggerKey]*activeTrigger{}
+		e.symbols[Symbol] = watched
+		e.watchers.Add(1)
+		go e.watch(Symbol)
+	}
+	if t, ok := watched[key]; ok {
+		// Setting an existing trigger only changes its price, the same as in the triggers table
+		t.Price = price
+		return
+	}
+	watched[key] = &activeTrigger{UserID, Symbol, method, price, transactionNum}
+}
+
+// Stops watching a trigger. The symbol's watcher exits on its next tick if it has nothing left to watch.
+func (e *triggerEngine) remove(UserID string, Symbol string, method string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if watched, ok := e.symbols[Symbol]; ok {
+		delete(watched, triggerKey{UserID, method})
+	}
+}
+
+// Returns a copy of the symbol's triggers. If there are none, the symbol is no longer watched and false is returned.
+func (e *triggerEngine) snapshot(Symbol string) ([]activeTrigger, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	watched := e.symbols[Symbol]
+	if len(watched) == 0 {
+		delete(e.symbols, Symbol)
+		return nil, false
+	}
+	list := make([]activeTrigger, 0, len(watched))
+	for _, t := range watched {
+		list = append(list, *t)
+	}
+	return list, true
+}
+
+// Removes the trigger from memory if it still has the given price, so a trigger that was updated
+// or cancelled while the quote was being retrieved isn't fired.
+func (e *triggerEngine) take(t activeTrigger) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	watched := e.symbols[t.Symbol]
+	key := triggerKey{t.UserID, t.Method}
+	current, ok := watched[key]
+	if !ok || current.Price != t.Price {
+		return false
+	}
+	delete(watched, key)
+	return true
+}
+
+// Returns how many triggers are being watched
+func (e *triggerEngine) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for _, watched := range e.symbols {
+		n += len(watched)
+	}
+	return n
+}
+
+// Stops watching every stock and waits for triggers that are firing to finish, or for the context to be done
+func (e *triggerEngine) stop(ctx context.Context) {
+	e.mu.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.done)
+	}
+	e.mu.Unlock()
+
+	if !shutdown.Wait(ctx, &e.watchers) {
+		slog.Warn("Gave up waiting for triggers to finish firing")
+	}
+}
+
+// Watches a single stock until none of its triggers remain or the engine is stopped. Should be called in a goroutine.
+func (e *triggerEngine) watch(Symbol string) {
+	defer e.watchers.Done()
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		list, ok := e.snapshot(Symbol)
+		if !ok {
 			return
 		}
+		e.evaluate(Symbol, list)
+	}
+}
+
+// Retrieves one quote for the symbol and fires every trigger it reaches
+func (e *triggerEngine) evaluate(Symbol string, list []activeTrigger) {
+	// Triggers fire long after the commands that set them have finished, so they aren't part of their traces
+	ctx := context.Background()
+
+	// The quote is logged under the first trigger's user and transaction
+	quote, _, err := getQuote(ctx, Symbol, list[0].TransactionNum, list[0].UserID)
+	if err != nil {
+		// Try again on the next tick
+		reportError(ctx, commandInfo{list[0].TransactionNum, triggerCommand(list[0].Method), list[0].UserID, Symbol, 0}, err,
+			"Failed to get quote for triggers on "+Symbol)
+		return
+	}
+
+	for _, t := range list {
+		if t.reached(quote) && e.take(t) {
+			triggerFires.WithLabelValues(t.Method).Inc()
+			// Firing changes the user's account, so it waits its turn behind the user's commands
+			t := t
+			err := userQueues.run(t.UserID, func() {
+				fireTrigger(ctx, t.UserID, t.Symbol, t.Method, quote)
+			})
+			if err != nil {
+				// Watched again, so it fires on a later tick
+				reportError(ctx, commandInfo{t.TransactionNum, triggerCommand(t.Method), t.UserID, t.Symbol, quote}, err,
+					"Failed to wait for the user's commands to fire a trigger")
+				e.add(t.UserID, t.Symbol, t.Method, t.Price, t.TransactionNum)
+			}
+		}
+	}
+}
+
+// Resumes watching every trigger in the triggers table that still has a buy or sell amount to act on.
+// Triggers only live in memory, so this has to be called when the server starts.
+func recoverTriggers() {
+	list, err := store.Triggers.All()
+	if err != nil {
+		failGracefully(err, "Failed to get triggers to recover")
+		return
+	}
+
+	recovered := 0
+	for _, t := range list {
+		amounts := store.BuyAmounts
+		if t.Method == "sell" {
+			amounts = store.SellAmounts
+		}
+		// Without an amount the trigger would have nothing to buy or sell when it fires
+		_, err := amounts.Get(t.UserID, t.Symbol)
+		if err == errNoAmount {
+			continue
+		}
+		if err != nil {
+			failGracefully(err, "Failed to get "+t.Method+" amount to recover trigger")
+			continue
+		}
+
+		triggers.add(t.UserID, t.Symbol, t.Method, t.Price, t.TransactionNum)
+		logSystemEvent(context.Background(), t.TransactionNum, "transaction-server", triggerCommand(t.Method), t.UserID, t.Symbol, "", t.Price)
+		recovered++
 	}
+	slog.Info("Recovered triggers", "count", recovered)
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+)
+
+var errUnavailable = errors.New("database unavailable")
+
+// Holdings that can't have shares added to them
+type failingHoldings struct{ HoldingRepository }
+
+func (failingHoldings) Add(UserID string, Symbol string, quantity int) error { return errUnavailable }
+
+// Users whose balances can't be added to
+type failingUsers struct{ UserRepository }
+
+func (failingUsers) Deposit(UserID string, amount money.Money) error { return errUnavailable }
+
+func TestFireBuyTrigger(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    bool
+		balance int64
+		shares  int
+	}{
+		{"buys the shares and refunds the rest", false, 9052, 4},
+		{"refunds everything when the shares can't be added", true, 10000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore(t)
+			store.Users.Deposit("alice", 10000)
+			ReserveFunds("alice", buyAmountReservationID("alice", "ABC"), 1000)
+			store.BuyAmounts.Add("alice", "ABC", 1000)
+			if tt.fail {
+				store.Holdings = failingHoldings{store.Holdings}
+			}
+
+			fireBuyTrigger(context.Background(), "alice", "ABC", 237, 1)
+
+			if got := balanceOf(t, "alice"); got.Cents() != tt.balance {
+				t.Errorf("balance = %s, want %d cents", got, tt.balance)
+			}
+			if got := sharesOf(t, "alice", "ABC"); got != tt.shares {
+				t.Errorf("shares = %d, want %d", got, tt.shares)
+			}
+			if got, err := store.Reservations.TotalFunds("alice"); err != nil || got != 0 {
+				t.Errorf("reserved = %s, %v; want nothing", got, err)
+			}
+		})
+	}
+}
+
+func TestFireSellTrigger(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    bool
+		balance int64
+		shares  int
+	}{
+		{"sells the reserved shares", false, 1200, 6},
+		{"returns the shares when the proceeds can't be credited", true, 0, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetStore(t)
+			store.Users.Create("alice")
+			store.Holdings.Add("alice", "ABC", 10)
+			ReserveShares("alice", sellAmountReservationID("alice", "ABC"), "ABC", 4)
+			store.SellAmounts.Add("alice", "ABC", 1000)
+			if tt.fail {
+				store.Users = failingUsers{store.Users}
+			}
+
+			fireSellTrigger(context.Background(), "alice", "ABC", 300, 1)
+
+			if got := balanceOf(t, "alice"); got.Cents() != tt.balance {
+				t.Errorf("balance = %s, want %d cents", got, tt.balance)
+			}
+			if got := sharesOf(t, "alice", "ABC"); got != tt.shares {
+				t.Errorf("shares = %d, want %d", got, tt.shares)
+			}
+			if got, err := heldShares("alice", sellAmountReservationID("alice", "ABC")); err != nil || got != 0 {
+				t.Errorf("reserved = %d, %v; want nothing", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// How long a user's lock lasts without being renewed. It's renewed while the command runs, so it
+	// only runs out if the server holding it dies.
+	userLockTTL = 10 * time.Second
+
+	// The longest a command waits for another server to finish one of the user's commands
+	userLockWait     = 30 * time.Second
+	userLockPollRate = 10 * time.Millisecond
+)
+
+var errUserLockUnavailable = errors.New("can't take the user's lock")
+
+// Renews the lock only if it's still held by the given token
+var renewLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Runs the commands for each user strictly one at a time, in the order they arrive, while commands for
+// different users run in parallel. Anything that reads and then writes a user's balance, stocks,
+// reservations or pending orders must run through here.
+//
+// Each user has their own line, so a command that's slow, e.g. waiting on the quote server, only holds
+// up that user's later commands. The line only orders commands within this server, so each command also
+// holds the user's lock in Redis while it runs, which commands for the user on other servers wait for.
+type userQueue struct {
+	mu    sync.Mutex
+	users map[string]*userLine // only users with a command running have a line
+}
+
+// The commands waiting behind a user's running command, in the order they arrived
+type userLine struct {
+	waiting []chan struct{}
+}
+
+var userQueues = newUserQueue()
+
+func newUserQueue() *userQueue {
+	return &userQueue{users: map[string]*userLine{}}
+}
+
+// Runs fn once the user's earlier commands have finished, on this server and every other, and waits for
+// it to finish. Returns an error without running fn if the user's lock in Redis can't be taken.
+// fn must not call run for the same user, since it would wait on itself forever.
+func (q *userQueue) run(UserID string, fn func()) error {
+	turn := make(chan struct{})
+	q.mu.Lock()
+	if line, ok := q.users[UserID]; ok {
+		line.waiting = append(line.waiting, turn)
+	} else {
+		q.users[UserID] = &userLine{}
+		close(turn)
+	}
+	q.mu.Unlock()
+
+	<-turn
+	// Runs even if fn panics, so the user's next command isn't stuck behind it
+	defer q.next(UserID)
+
+	unlock, err := lockUser(UserID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	fn()
+	return nil
+}
+
+// Takes the user's lock in Redis, waiting for another server that holds it to finish. The lock is renewed
+// until the returned function releases it.
+func lockUser(UserID string) (func(), error) {
+	key := "user_lock:" + UserID
+	token := newLockToken()
+	deadline := time.Now().Add(userLockWait)
+	for {
+		acquired, err := cache.SetNX(key, token, userLockTTL).Result()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errUserLockUnavailable, err)
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: another server has held it for %s", errUserLockUnavailable, userLockWait)
+		}
+		time.Sleep(userLockPollRate)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(userLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := renewLockScript.Run(cache, []string{key}, token, int64(userLockTTL/time.Millisecond)).Err()
+				failGracefully(err, "Failed to renew user lock")
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		releaseLockScript.Run(cache, []string{key}, token)
+	}, nil
+}
+
+// Starts the user's next command, or removes their line if nothing is waiting
+func (q *userQueue) next(UserID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	line := q.users[UserID]
+	if len(line.waiting) == 0 {
+		delete(q.users, UserID)
+		return
+	}
+	close(line.waiting[0])
+	line.waiting = line.waiting[1:]
+}
+
+// Wraps a handler so its request runs on the queue of the user named in the request's UserID, which
+// tracing.Middleware has read from its body. Requests without a UserID run right away.
+func serializeByUser(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := tracing.CommandFrom(r.Context())
+		if req.UserID == "" {
+			handler(w, r)
+			return
+		}
+		// How long the command waited behind the user's other commands
+		_, wait := tracing.StartSpan(r.Context(), "user queue")
+		err := userQueues.run(req.UserID, func() {
+			wait.End()
+			handler(w, r)
+		})
+		if err != nil {
+			wait.End()
+			cmd := commandInfo{TransactionNum: req.TransactionNum, Command: strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/")), UserID: req.UserID}
+			writeError(w, r, cmd, err, "Failed to wait for the user's other commands")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+	"github.com/go-redis/redis"
+)
+
+func TestSerializeByUserRefusesWithoutLock(t *testing.T) {
+	// A closed client fails every command, the same as one whose Redis is down
+	saved := cache
+	cache = redis.NewClient(&redis.Options{Addr: cfg.RedisAddr})
+	cache.Close()
+	defer func() { cache = saved }()
+
+	ran := false
+	if err := userQueues.run("alice", func() { ran = true }); !errors.Is(err, errUserLockUnavailable) {
+		t.Errorf("run() = %v, want %v", err, errUserLockUnavailable)
+	}
+
+	h := tracing.Middleware(serializeByUser(func(w http.ResponseWriter, r *http.Request) { ran = true }))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/add", strings.NewReader(`{"UserID": "alice", "Amount": 10, "TransactionNum": 1}`)))
+
+	if ran {
+		t.Error("ran the command without holding the user's lock")
+	}
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "user_lock_unavailable") {
+		t.Errorf("replied %d %s, want %d user_lock_unavailable", w.Code, w.Body.String(), http.StatusServiceUnavailable)
+	}
+
+	// The line isn't left stuck behind the failed commands
+	done := make(chan struct{})
+	go func() {
+		userQueues.run("alice", func() {})
+		close(done)
+	}()
+	<-done
+}
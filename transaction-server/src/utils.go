@@ -1,145 +1,108 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"os"
+	"context"
+	"log/slog"
 	"strings"
 	"time"
 
 	"strconv"
 
-	"net"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
 	"github.com/go-redis/redis"
-	_ "github.com/herenow/go-crate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
-// Connects to the database
-func loadDb() *sql.DB {
-	db, err := sql.Open("crate", dbstring)
-	// If can't connect to DB
-	failOnError(err, "Couldn't connect to CrateDB")
-	return db
-}
-
-func runningInDocker() bool {
-	if _, err := os.Stat("/.dockerenv"); !os.IsNotExist(err) {
-		return true
-	}
-	return false
-}
-
-// Checks and panics on error
+// Checks and logs an error
 // Parameters:
 // 		err: 	the error to check
-// 		msg: 	a message to print to the console if an error is found
+// 		msg: 	a message to log if an error is found
 //
-func failOnError(err error, msg string) {
-	if err != nil {
-		fmt.Printf("%s: %s", msg, err)
-
-	}
-}
-
 func failGracefully(err error, msg string) {
 	if err != nil {
-		fmt.Printf("%s: %s", msg, err)
+		slog.Error(msg, "error", err)
 	}
 }
-func SocketClient(symbol string, userID string) string {
-	addr := "quoteserve.seng.uvic.ca:4452"
-	conn, err := net.Dial("tcp", addr)
-
-	defer conn.Close()
 
-	failOnError(err, "Failed to connect to quote server")
-	payload := fmt.Sprintf("%s,%s\r", symbol, userID)
-	conn.Write([]byte(payload))
-
-	buff := make([]byte, 2048)
-	n, err := conn.Read(buff)
-	if err != nil {
-		fmt.Println("Error reading stock quote from quote server")
-	}
+// Returns the current time as a unix timestamp in milliseconds
+func createTimestamp() int64 {
+	return time.Now().UTC().UnixNano() / int64(time.Millisecond)
+}
 
-	quote := string(buff[:n])
-	return quote
+// Stores a quote in the cache for the configured TTL along with the time it was retrieved
+func cacheQuote(symbol string, price money.Money, timestamp int64) {
+	cache.Set(symbol, price.String()+","+strconv.FormatInt(timestamp, 10), cfg.QuoteCacheTTL)
 }
 
 // Returns a fresh quote for a given stock symbol.
 // If there is a fresh quote cached, then that value is returned. Otherwise, it fetches and stores one.
 // Parameters:
+//		ctx: 		the context of the command that wants the quote
 //		symbol: 	(string) symbol of the stock to quote
 //
-func getQuote(symbol string, transactionNum int, userID string) float64 {
+// Returns the price of the stock and the time (unix ms) the quote was retrieved from the quote server
+func getQuote(ctx context.Context, symbol string, transactionNum int, userID string) (money.Money, int64, error) {
 	// Check if symbol is in cache
-        quote, err := cache.Get(symbol).Result()
-        
+	price, timestamp, err := getCachedQuote(symbol)
 
 	if err == redis.Nil {
+		quoteCacheLookups.WithLabelValues("miss").Inc()
+		// Only one fetch per symbol happens at a time. Everyone else waits for its result
+		return fetchQuoteCoalesced(ctx, symbol, transactionNum, userID)
+	}
+	if err == nil {
+		quoteCacheLookups.WithLabelValues("hit").Inc()
+	}
+	return price, timestamp, err
+}
 
-		if os.Getenv("DEBUG") == "TRUE" {
-
-			//Get quote from the quote server and store it with ttl 60s
-			r, err := http.Get("http://localhost:3000/quote")
-			failOnError(err, "Failed to retrieve quote from quote server")
-			defer r.Body.Close()
-
-			failOnError(err, "Failed to parse quote server response")
-			decoder := json.NewDecoder(r.Body)
-
-			res := struct {
-				CryptoKey string
-				Quote     float64
-			}{"", 0.0}
-
-			err = decoder.Decode(&res)
-			failOnError(err, "Failed to parse quote server response data")
-
-			quoteServerTime := time.Now().UTC().Unix()
-			logQuoteServer(transactionNum, "transaction-server", userID, symbol, res.CryptoKey, quoteServerTime, res.Quote)
-
-			cache.Set(symbol, strconv.FormatFloat(res.Quote, 'f', -1, 64), 60000000000)
-			return res.Quote
-		} else {
-			r := SocketClient(symbol, userID)
-			var err error
+// Returns the cached quote for a symbol, or redis.Nil if there isn't one
+func getCachedQuote(symbol string) (money.Money, int64, error) {
+	quote, err := cache.Get(symbol).Result()
+	if err != nil {
+		return 0, 0, err
+	}
 
-			res := struct {
-				CryptoKey       string
-				Quote           float64
-				QuoteServerTime int64
-			}{"", 0.0, 0}
-			spl := strings.Split(r, ",")
-			res.QuoteServerTime, err = strconv.ParseInt(spl[3], 10, 64)
-			res.CryptoKey = spl[4]
-			res.Quote, err = strconv.ParseFloat(spl[0], 64)
-			failOnError(err, "failed to get stuff from quote")
+	spl := strings.Split(quote, ",")
+	price, err := money.Parse(spl[0])
+	if err != nil {
+		return 0, 0, err
+	}
 
-			logQuoteServer(transactionNum, "transaction-server", userID, symbol, res.CryptoKey, res.QuoteServerTime, res.Quote)
-			cache.Set(symbol, strconv.FormatFloat(res.Quote, 'f', -1, 64), 60000000000)
-			return res.Quote
-		}
-	} else {
-		
-		// Otherwise, return the cached value
-		quote, err := strconv.ParseFloat(quote, 32)
-		failOnError(err, "Failed to parse float from quote")
-		return quote
+	// Quotes cached without a timestamp are treated as fresh
+	timestamp := createTimestamp()
+	if len(spl) > 1 {
+		timestamp, err = strconv.ParseInt(spl[1], 10, 64)
+		failGracefully(err, "Failed to parse quote timestamp")
 	}
+	return price, timestamp, nil
 }
 
-// Reserves the given amount of money from the given user
-// Parameters:
-// 		UserID: 	the userID for the user to reserve funds from
-// 		amount:		the amount of money to reserve
-//
-func ReserveFunds(UserID string, amount float64) {
+// Gets a quote from the quote provider and stores it in the cache
+func fetchQuote(ctx context.Context, symbol string, transactionNum int, userID string) (money.Money, int64, error) {
+	// Failures are reported to the audit log by the command that asked for the quote
+	ctx, span := tracing.StartSpan(ctx, "quote server",
+		attribute.String("symbol", symbol), attribute.String("provider", cfg.QuoteProvider))
+	defer span.End()
 
-}
+	// Whoever holds the symbol's quote lock has to finish before it expires
+	ctx, cancel := context.WithTimeout(ctx, quoteFetchTimeout)
+	defer cancel()
 
-func ReleaseFunds(UserID string, amount float64) {
+	start := time.Now()
+	res, err := quoteProvider.GetQuote(ctx, symbol, userID)
+	quoteServerDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		quoteServerErrors.Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, 0, err
+	}
+	logQuoteServer(ctx, transactionNum, "transaction-server", userID, symbol, res.CryptoKey, res.QuoteServerTime, res.Price)
 
+	timestamp := createTimestamp()
+	cacheQuote(symbol, res.Price, timestamp)
+	return res.Price, timestamp, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/config"
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
+)
+
+// Everything about the web server that can be configured. See the config package for how it's loaded.
+type webConfig struct {
+	Port            int           `config:"port" default:"8123" help:"port to listen on"`
+	TransactionURL  string        `config:"transaction_url" default:"http://localhost:8080" help:"base URL of the transaction server"`
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" default:"30s" help:"how long to wait for running requests when stopping"`
+	LogLevel        string        `config:"log_level" default:"info" help:"lowest level to log, one of debug, info, warn or error. Can be changed at /admin/log_level"`
+	AdminToken      string        `config:"admin_token" secret:"true" help:"bearer token /admin/log_level requires. It's disabled without one"`
+	TraceExporter   string        `config:"trace_exporter" default:"none" help:"where to send trace spans, one of none, otlp or file"`
+	TraceTarget     string        `config:"trace_target" help:"host:port of the OTLP/HTTP collector, or the file to write spans to, defaults to the exporter's"`
+}
+
+func (c *webConfig) Validate() error {
+	return config.Check(
+		config.CheckPort("port", c.Port),
+		config.CheckURL("transaction_url", c.TransactionURL, "http", "https"),
+		config.CheckPositive("shutdown_timeout", c.ShutdownTimeout),
+		config.CheckOneOf("log_level", c.LogLevel, logging.Levels...),
+		tracing.CheckSettings(c.TraceExporter, &c.TraceTarget),
+	)
+}
+
+var cfg, settings = loadConfig()
+
+// Loads the config from the command line, environment and config file. Exits if it's invalid.
+func loadConfig() (webConfig, *config.Loaded) {
+	var c webConfig
+	logging.Init("web-server")
+	loaded, err := config.Load(&c, "web-server", os.Args[1:])
+	if err != nil {
+		slog.Error("Invalid config", "error", err)
+		os.Exit(2)
+	}
+	logging.SetLevel(c.LogLevel)
+	return c, loaded
+}
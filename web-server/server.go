@@ -3,68 +3,95 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+
+	"github.com/LeeZeitz/DayTradingSystem/shared/health"
+	"github.com/LeeZeitz/DayTradingSystem/shared/logging"
+	"github.com/LeeZeitz/DayTradingSystem/shared/metrics"
+	"github.com/LeeZeitz/DayTradingSystem/shared/money"
+	"github.com/LeeZeitz/DayTradingSystem/shared/shutdown"
+	"github.com/LeeZeitz/DayTradingSystem/shared/tracing"
 )
 
-func runningInDocker() bool {
-	if _, err := os.Stat("/.dockerenv"); !os.IsNotExist(err) {
-		return true
-	}
-	return false
-}
-
-var transactionServer = func() string {
-	if runningInDocker() {
-		print("Using http://transaction:8080")
-		return "http://transaction:8080"
-	}
-	return "http://localhost:8080"
-}()
+var transactionServer = cfg.TransactionURL
 
 // Checks and panics on error
 // Parameters:
 //     err:    the error to check
-//     msg:    a message to print to the console if an error is found
+//     msg:    a message to log if an error is found
 
 func failOnError(err error, msg string) {
 	if err != nil {
-		fmt.Printf("%s: %s", msg, err)
+		slog.Error(msg, "error", err)
 		panic(err)
 	}
 }
 
+// Sends the request to the transaction server and passes its response back to the client unchanged,
+// status code and headers included. The request's trace is carried on to the transaction server.
+func forwardRequest(w http.ResponseWriter, r *http.Request, path string, req interface{}) {
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(req)
+
+	post, err := http.NewRequest(http.MethodPost, transactionServer+path, b)
+	failOnError(err, "Failed to create the request")
+	post.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r1, err := tracing.Client.Do(post.WithContext(r.Context()))
+	if err != nil {
+		cmd := tracing.CommandFrom(r.Context())
+		logging.ForCommand(r.Context(), cmd.UserID, cmd.TransactionNum, "").Error("Failed to reach the transaction server", "path", path, "error", err)
+		writeError(w, http.StatusBadGateway, "transaction_server_unavailable", "Failed to reach the transaction server")
+		return
+	}
+	defer r1.Body.Close()
+
+	for key, values := range r1.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(r1.StatusCode)
+	io.Copy(w, r1.Body)
+}
+
+// Replies with an error in the same shape as the transaction server's responses, for requests
+// that never reach it
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	payload, _ := json.Marshal(struct {
+		Status         string
+		Code           string
+		Message        string
+		TransactionNum int
+	}{"error", code, message, 0})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
 func addHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
-	w.WriteHeader(http.StatusOK)
-
 	req := struct {
 		UserID         string
-		Amount         float64
+		Amount         money.Money
 		TransactionNum int
-	}{"", 0.0, 0}
+	}{"", 0, 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	// Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-
-	r1, err1 := http.Post(transactionServer+"/add", "application/json; charset=utf-8", b)
-	failOnError(err1, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/add", req)
 }
 
 func quoteHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		Symbol         string
@@ -73,45 +100,35 @@ func quoteHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/quote", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/quote", req)
 }
 
 func buyHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
-		Amount         float64 // dolar amount of a stock to buy
+		Amount         money.Money // dolar amount of a stock to buy
 		Symbol         string
 		TransactionNum int
-	}{"", 0.0, "", 0}
+	}{"", 0, "", 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/buy", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/buy", req)
 }
 
 func commitBuyHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		TransactionNum int
@@ -119,21 +136,16 @@ func commitBuyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/commit_buy", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/commit_buy", req)
 }
 
 func cancelBuyHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		TransactionNum int
@@ -141,45 +153,35 @@ func cancelBuyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/cancel_buy", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/cancel_buy", req)
 }
 
 func sellHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
-		Amount         float64 // Dollar value to sell
+		Amount         money.Money // Dollar value to sell
 		Symbol         string
 		TransactionNum int
-	}{"", 0.0, "", 0}
+	}{"", 0, "", 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/sell", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/sell", req)
 }
 
 func commitSellHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		TransactionNum int
@@ -187,21 +189,16 @@ func commitSellHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/commit_sell", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/commit_sell", req)
 }
 
 func cancelSellHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		TransactionNum int
@@ -209,45 +206,35 @@ func cancelSellHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/cancel_sell", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/cancel_sell", req)
 }
 
 func setBuyAmountHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
-		UserID         string  // id of the user buying
-		Symbol         string  // symbol of the stock to buy
-		Amount         float64 // dollar amount of stock to buy
+		UserID         string      // id of the user buying
+		Symbol         string      // symbol of the stock to buy
+		Amount         money.Money // dollar amount of stock to buy
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/set_buy_amount", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/set_buy_amount", req)
 }
 
 func cancelSetBuyHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		Symbol         string
@@ -256,93 +243,73 @@ func cancelSetBuyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/cancel_set_buy", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/cancel_set_buy", req)
 }
 
 func setBuyTriggerHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		Symbol         string
-		Price          float64
+		Price          money.Money
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/set_buy_trigger", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/set_buy_trigger", req)
 }
 
 func setSellAmountHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		Symbol         string
-		Amount         float64 // dollar amount of stock to sell
+		Amount         money.Money // dollar amount of stock to sell
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/set_sell_amount", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/set_sell_amount", req)
 }
 
 func setSellTriggerHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		Symbol         string
-		Price          float64
+		Price          money.Money
 		TransactionNum int
-	}{"", "", 0.0, 0}
+	}{"", "", 0, 0}
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/set_sell_trigger", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/set_sell_trigger", req)
 }
 
 func cancelSetSellHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		UserID         string
 		Symbol         string
@@ -351,21 +318,16 @@ func cancelSetSellHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/cancel_set_sell", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/cancel_set_sell", req)
 }
 
 func dumpLogHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		TransactionNum int
 		Filename       string
@@ -374,21 +336,16 @@ func dumpLogHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/dumplog", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/dumplog", req)
 }
 
 func displaySummaryHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	w.WriteHeader(http.StatusOK)
 	req := struct {
 		TransactionNum int
 		UserID         string
@@ -396,16 +353,12 @@ func displaySummaryHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Decode request parameters into struct
 	err := decoder.Decode(&req)
-	failOnError(err, "Failed to parse the request")
-
-	//Encode request parameters into a struct
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-	r1, err := http.Post(transactionServer+"/display_summary", "application/json; charset=utf-8", b)
-	failOnError(err, "Failed to post the request")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
 
-	body, err := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	forwardRequest(w, r, "/display_summary", req)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -414,34 +367,47 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		UserID string
 	}{""}
 
-	_ = decoder.Decode(&req)
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(req)
-
-	r1, _ := http.Post(transactionServer+"/login", "application/json; charset=utf-8", b)
-
-	body, _ := ioutil.ReadAll(r1.Body)
-	w.Write([]byte(body))
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Failed to parse the request: "+err.Error())
+		return
+	}
+	forwardRequest(w, r, "/login", req)
 }
 
 func main() {
-	port := ":8123"
-	http.HandleFunc("/add", addHandler)
-	http.HandleFunc("/quote", quoteHandler)
-	http.HandleFunc("/buy", buyHandler)
-	http.HandleFunc("/commit_buy", commitBuyHandler)
-	http.HandleFunc("/cancel_buy", cancelBuyHandler)
-	http.HandleFunc("/sell", sellHandler)
-	http.HandleFunc("/commit_sell", commitSellHandler)
-	http.HandleFunc("/cancel_sell", cancelSellHandler)
-	http.HandleFunc("/set_buy_amount", setBuyAmountHandler)
-	http.HandleFunc("/cancel_set_buy", cancelSetBuyHandler)
-	http.HandleFunc("/set_buy_trigger", setBuyTriggerHandler)
-	http.HandleFunc("/set_sell_amount", setSellAmountHandler)
-	http.HandleFunc("/set_sell_trigger", setSellTriggerHandler)
-	http.HandleFunc("/cancel_set_sell", cancelSetSellHandler)
-	http.HandleFunc("/dumplog", dumpLogHandler)
-	http.HandleFunc("/display_summary", displaySummaryHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.ListenAndServe(port, nil)
+	settings.Print(os.Stdout)
+	flushTraces, err := tracing.Start("web-server", cfg.TraceExporter, cfg.TraceTarget)
+	if err != nil {
+		slog.Error("Failed to start tracing", "error", err)
+		os.Exit(1)
+	}
+
+	port := ":" + strconv.Itoa(cfg.Port)
+	metrics.HandleFunc("/add", addHandler)
+	metrics.HandleFunc("/quote", quoteHandler)
+	metrics.HandleFunc("/buy", buyHandler)
+	metrics.HandleFunc("/commit_buy", commitBuyHandler)
+	metrics.HandleFunc("/cancel_buy", cancelBuyHandler)
+	metrics.HandleFunc("/sell", sellHandler)
+	metrics.HandleFunc("/commit_sell", commitSellHandler)
+	metrics.HandleFunc("/cancel_sell", cancelSellHandler)
+	metrics.HandleFunc("/set_buy_amount", setBuyAmountHandler)
+	metrics.HandleFunc("/cancel_set_buy", cancelSetBuyHandler)
+	metrics.HandleFunc("/set_buy_trigger", setBuyTriggerHandler)
+	metrics.HandleFunc("/set_sell_amount", setSellAmountHandler)
+	metrics.HandleFunc("/set_sell_trigger", setSellTriggerHandler)
+	metrics.HandleFunc("/cancel_set_sell", cancelSetSellHandler)
+	metrics.HandleFunc("/dumplog", dumpLogHandler)
+	metrics.HandleFunc("/display_summary", displaySummaryHandler)
+	metrics.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/healthz", health.Healthz)
+	http.HandleFunc("/readyz", health.Readyz(health.HTTPCheck("transaction", transactionServer+"/healthz")))
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/admin/log_level", logging.LevelHandler(cfg.AdminToken))
+	server := &http.Server{Addr: port, Handler: tracing.Middleware(http.DefaultServeMux)}
+	err = shutdown.ListenAndServe(server, cfg.ShutdownTimeout, flushTraces)
+	if err != nil {
+		slog.Error("Web server stopped", "error", err)
+	}
 }